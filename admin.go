@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	ADMIN_PREFIX string = "/admin"
+)
+
+var errAdminForbidden = &APIError{http.StatusForbidden, "forbidden", "Missing or invalid admin token"}
+
+// Admin endpoints require the configured admin token, or an API token with
+// the admin scope, as a bearer token.
+func (s *Server) initAdminRoutes() {
+	s.handle("GET", ADMIN_PREFIX+"/backup", s.requireAdmin(s.AdminBackup))
+	s.handle("GET", ADMIN_PREFIX+"/export", s.requireAdmin(s.AdminExport))
+}
+
+func (s *Server) requireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.config.adminToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.config.adminToken)) == 1 {
+			h(w, r, params)
+			return
+		}
+		if token, apiErr := s.bearerToken(r); apiErr != nil || token == nil || !token.Has(SCOPE_ADMIN) {
+			s.writeError(w, errAdminForbidden)
+			return
+		}
+		h(w, r, params)
+	}
+}
+
+// AdminBackup streams a backup archive, see WriteBackup.
+func (s *Server) AdminBackup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	attachTar(w, "goimg-backup")
+	if err := WriteBackup(w, s.imageDao.db, s.fs.storage, s.logger); err != nil {
+		// Headers are long gone, so all we can do is cut the archive short.
+		s.logger.Printf("Error writing backup: %s\n", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// AdminExport streams an export archive, see WriteExport.
+func (s *Server) AdminExport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	attachTar(w, "goimg-export")
+	if _, err := WriteExport(w, s.imageDao, s.fs.storage, s.logger); err != nil {
+		s.logger.Printf("Error writing export: %s\n", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// attachTar sets the headers for downloading a tar archive named after
+// prefix and the current time.
+func attachTar(w http.ResponseWriter, prefix string) {
+	filename := fmt.Sprintf("%s-%s.tar", prefix, time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/disintegration/imaging"
+)
+
+// animation is what scanning the blocks of an animated image found,
+// without decoding it.
+type animation struct {
+	frames   int
+	duration int   // Milliseconds of one loop
+	pixels   int64 // Frames times canvas size, roughly what decoding them all takes
+}
+
+// probeAnimation scans the GIF or PNG in the file at path, stopping once
+// there are more than max frames if max is not 0. It returns nil for other
+// types and still PNGs.
+func probeAnimation(path string, fileType string, max int) (*animation, error) {
+	if fileType != "gif" && fileType != "png" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fileType == "gif" {
+		return scanGIF(bufio.NewReader(f), max)
+	}
+	return scanAPNG(bufio.NewReader(f))
+}
+
+// scanGIF walks the blocks of a GIF without decompressing them, counting
+// frames and adding up their delays.
+func scanGIF(r *bufio.Reader, max int) (*animation, error) {
+	var header [13]byte // signature and logical screen descriptor
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, ErrDecode
+	}
+	if header[10]&0x80 != 0 { // global color table
+		if err := skip(r, 3<<(header[10]&0x07+1)); err != nil {
+			return nil, err
+		}
+	}
+	canvas := int64(binary.LittleEndian.Uint16(header[6:])) * int64(binary.LittleEndian.Uint16(header[8:]))
+
+	anim := &animation{}
+	for max == 0 || anim.frames <= max {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrDecode
+		}
+		switch introducer {
+		case 0x21: // extension
+			label, err := r.ReadByte()
+			if err != nil {
+				return nil, ErrDecode
+			}
+			if label == 0xF9 { // graphic control, holds the frame delay
+				var gce [5]byte
+				if _, err = io.ReadFull(r, gce[:]); err != nil || gce[0] != 4 {
+					return nil, ErrDecode
+				}
+				anim.duration += int(binary.LittleEndian.Uint16(gce[2:])) * 10
+			}
+		case 0x2C: // image descriptor
+			var desc [9]byte
+			if _, err = io.ReadFull(r, desc[:]); err != nil {
+				return nil, ErrDecode
+			}
+			// local color table, then the LZW minimum code size
+			n := 1
+			if desc[8]&0x80 != 0 {
+				n += 3 << (desc[8]&0x07 + 1)
+			}
+			if err = skip(r, n); err != nil {
+				return nil, err
+			}
+			anim.frames++
+			anim.pixels += canvas
+		case 0x3B: // trailer
+			return anim, nil
+		default:
+			return nil, ErrDecode
+		}
+		if err = skipSubBlocks(r); err != nil {
+			return nil, err
+		}
+	}
+	return anim, nil
+}
+
+// scanAPNG reads the frame count from the animation control chunk of a
+// PNG and adds up the delays of its frames. Still PNGs return nil.
+func scanAPNG(r *bufio.Reader) (*animation, error) {
+	if err := skip(r, len(pngSignature)); err != nil {
+		return nil, err
+	}
+	var anim *animation
+	var canvas int64
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, ErrDecode
+		}
+		n := int(binary.BigEndian.Uint32(header[:4]))
+		var data []byte
+		switch string(header[4:]) {
+		case "IHDR", "acTL", "fcTL":
+			if n > 64 {
+				return nil, ErrDecode
+			}
+			data = make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, ErrDecode
+			}
+		case "IDAT":
+			if anim == nil { // the control chunk comes before the image data
+				return nil, nil
+			}
+			fallthrough
+		default:
+			if err := skip(r, n); err != nil {
+				return nil, err
+			}
+		}
+		if err := skip(r, 4); err != nil { // CRC
+			return nil, err
+		}
+
+		switch string(header[4:]) {
+		case "IHDR":
+			if n >= 8 {
+				canvas = int64(binary.BigEndian.Uint32(data)) * int64(binary.BigEndian.Uint32(data[4:]))
+			}
+		case "acTL":
+			if n >= 4 {
+				frames := int(binary.BigEndian.Uint32(data))
+				anim = &animation{frames: frames, pixels: int64(frames) * canvas}
+			}
+		case "fcTL":
+			if anim != nil && n >= 26 {
+				num, den := int(binary.BigEndian.Uint16(data[20:])), int(binary.BigEndian.Uint16(data[22:]))
+				if den == 0 {
+					den = 100
+				}
+				anim.duration += num * 1000 / den
+			}
+		case "IEND":
+			return anim, nil
+		}
+	}
+}
+
+// writeThumbnail writes the thumbnail of the image in r to w, in the
+// format matching key's extension. Animated GIFs and APNGs keep their
+// animation as long as decoding every frame stays within the pixel limit,
+// otherwise they and every other image get a still of their first frame.
+func writeThumbnail(w io.Writer, r io.Reader, key string, cfg Config) error {
+	if ext := path.Ext(key); ext == ".gif" || ext == ".png" {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		var anim *animation
+		if ext == ".gif" {
+			anim, err = scanGIF(bufio.NewReader(bytes.NewReader(data)), cfg.maxFrames)
+		} else {
+			anim, err = scanAPNG(bufio.NewReader(bytes.NewReader(data)))
+		}
+		if err != nil {
+			return err
+		}
+		if anim != nil && anim.frames > 1 && (cfg.maxPixels == 0 || anim.pixels <= int64(cfg.maxPixels)*1000*1000) {
+			if ext == ".png" {
+				return thumbnailAPNG(w, data, anim.frames)
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				return ErrDecode
+			}
+			return gif.EncodeAll(w, thumbnailGIF(g))
+		}
+		r = bytes.NewReader(data)
+	}
+
+	img, err := decode(r, cfg)
+	if err != nil {
+		return err
+	}
+	return encode(w, thumbnail(img), key)
+}
+
+// thumbnailGIF scales down every frame of an animation. Frames can be
+// smaller than the canvas and depend on what earlier frames left behind,
+// so each is drawn onto the canvas the way a viewer would and the whole
+// canvas is scaled. The thumbnail frames then replace each other entirely.
+func thumbnailGIF(g *gif.GIF) *gif.GIF {
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		out.Image = append(out.Image, paletted(thumbnail(canvas), frame.Palette))
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return out
+}
+
+// paletted maps img onto the colours of the frame it came from, with a
+// transparent colour added if there is room.
+func paletted(img image.Image, palette color.Palette) *image.Paletted {
+	transparent := false
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = true
+			break
+		}
+	}
+	if !transparent && len(palette) < 256 {
+		palette = append(color.Palette{}, palette...)
+		palette = append(palette, color.Transparent)
+	}
+	p := image.NewPaletted(img.Bounds(), palette)
+	draw.Draw(p, p.Bounds(), img, img.Bounds().Min, draw.Src)
+	return p
+}
+
+func skip(r *bufio.Reader, n int) error {
+	if _, err := r.Discard(n); err != nil {
+		return ErrDecode
+	}
+	return nil
+}
+
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return ErrDecode
+		}
+		if size == 0 {
+			return nil
+		}
+		if err = skip(r, int(size)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGIF is a 4x3 GIF with a frame of one pixel for each delay, in
+// hundredths of a second. The second frame has a local color table.
+func testGIF(delays ...uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("GIF89a\x04\x00\x03\x00\x80\x00\x00")
+	b.WriteString("\x00\x00\x00\xff\xff\xff") // global color table
+	b.WriteString("\x21\xff\x0bNETSCAPE2.0\x03\x01\x00\x00\x00")
+	for i, delay := range delays {
+		b.WriteString("\x21\xf9\x04\x00")
+		binary.Write(&b, binary.LittleEndian, delay)
+		b.WriteString("\x00\x00")
+		if i == 1 {
+			b.WriteString("\x2c\x00\x00\x00\x00\x01\x00\x01\x00\x80\x00\x00\x00\xff\x00\x00")
+		} else {
+			b.WriteString("\x2c\x00\x00\x00\x00\x01\x00\x01\x00\x00")
+		}
+		b.WriteString("\x02\x02\x44\x01\x00") // LZW data
+	}
+	b.WriteString("\x21\xfe\x03abc\x00") // comment
+	b.WriteString("\x3b")
+	return b.Bytes()
+}
+
+// testAPNG is a 4x3 PNG with an acTL chunk claiming frames and an fcTL
+// chunk for each delay, as numerator and denominator. Its chunks are
+// never decoded, so they hold no real image data.
+func testAPNG(frames uint32, delays ...[2]uint16) []byte {
+	b := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	writePNGChunk(b, "IHDR", []byte("\x00\x00\x00\x04\x00\x00\x00\x03\x08\x06\x00\x00\x00"))
+	writePNGChunk(b, "acTL", binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, frames), 0))
+	for i, delay := range delays {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl, uint32(i))
+		binary.BigEndian.PutUint16(fctl[20:], delay[0])
+		binary.BigEndian.PutUint16(fctl[22:], delay[1])
+		writePNGChunk(b, "fcTL", fctl)
+		writePNGChunk(b, "IDAT", []byte("pixels"))
+	}
+	writePNGChunk(b, "IEND", nil)
+	return b.Bytes()
+}
+
+func TestScanGIF(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		max      int
+		want     *animation
+		wantFail bool
+	}{
+		{"still", testGIF(0), 10, &animation{1, 0, 12}, false},
+		{"animation", testGIF(10, 20, 30), 10, &animation{3, 600, 36}, false},
+		{"at the frame limit", testGIF(1, 1, 1), 3, &animation{3, 30, 36}, false},
+		{"over the frame limit", testGIF(1, 1, 1, 1, 1), 2, &animation{3, 30, 36}, false},
+		{"no frame limit", testGIF(1, 1, 1, 1, 1), 0, &animation{5, 50, 60}, false},
+		{"truncated", testGIF(10, 20)[:60], 10, nil, true},
+		{"unknown block", append(testGIF(10)[:len(testGIF(10))-1], 0x99), 10, nil, true},
+		{"too short", []byte("GIF89a"), 10, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			anim, err := scanGIF(bufio.NewReader(bytes.NewReader(test.data)), test.max)
+			if (err != nil) != test.wantFail {
+				t.Fatalf("error %v, want failure %v", err, test.wantFail)
+			}
+			if test.want != nil && *anim != *test.want {
+				t.Errorf("scanned %+v, want %+v", *anim, *test.want)
+			}
+		})
+	}
+	// The fixture must be a GIF that decodes, or the scan proves little.
+	if g, err := gif.DecodeAll(bytes.NewReader(testGIF(10, 20, 30))); err != nil || len(g.Image) != 3 {
+		t.Fatalf("fixture doesn't decode: %v", err)
+	}
+}
+
+func TestScanAPNG(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		want     *animation
+		wantFail bool
+	}{
+		{"animation", testAPNG(3, [2]uint16{1, 10}, [2]uint16{20, 100}, [2]uint16{5, 0}), &animation{3, 350, 36}, false},
+		{"frame count from acTL", testAPNG(600, [2]uint16{1, 10}), &animation{600, 100, 7200}, false},
+		{"truncated", testAPNG(2, [2]uint16{1, 10})[:50], nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			anim, err := scanAPNG(bufio.NewReader(bytes.NewReader(test.data)))
+			if (err != nil) != test.wantFail {
+				t.Fatalf("error %v, want failure %v", err, test.wantFail)
+			}
+			if test.want != nil && *anim != *test.want {
+				t.Errorf("scanned %+v, want %+v", *anim, *test.want)
+			}
+		})
+	}
+
+	// A PNG without acTL before its image data is a still.
+	still := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	writePNGChunk(still, "IHDR", []byte("\x00\x00\x00\x04\x00\x00\x00\x03\x08\x06\x00\x00\x00"))
+	writePNGChunk(still, "IDAT", []byte("pixels"))
+	writePNGChunk(still, "acTL", []byte("\x00\x00\x00\x02\x00\x00\x00\x00"))
+	writePNGChunk(still, "IEND", nil)
+	if anim, err := scanAPNG(bufio.NewReader(still)); err != nil || anim != nil {
+		t.Errorf("still PNG scanned as %+v, %v", anim, err)
+	}
+
+	oversized := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	writePNGChunk(oversized, "acTL", make([]byte, 100))
+	if _, err := scanAPNG(bufio.NewReader(oversized)); err == nil {
+		t.Error("oversized control chunk read")
+	}
+}
+
+func TestCheckImageFrameLimit(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		fileType  string
+		data      []byte
+		maxFrames int
+		wantLimit bool
+	}{
+		{"gif within", "gif", testGIF(1, 1, 1), 3, false},
+		{"gif over", "gif", testGIF(1, 1, 1, 1), 3, true},
+		{"gif unlimited", "gif", testGIF(1, 1, 1, 1), 0, false},
+		{"apng within", "png", testAPNG(2, [2]uint16{1, 10}), 2, false},
+		{"apng over", "png", testAPNG(501, [2]uint16{1, 10}), 500, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if err := os.WriteFile(path, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := checkImage(path, test.fileType, Config{maxFrames: test.maxFrames})
+			var limit *ImageLimitError
+			if errors.As(err, &limit) != test.wantLimit {
+				t.Errorf("error %v, want limit error %v", err, test.wantLimit)
+			}
+		})
+	}
+}
+
+func TestThumbnailPixelLimit(t *testing.T) {
+	// Three small frames on a canvas big enough that decoding every frame
+	// takes more than a megapixel.
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 600, Height: 600}}
+	for i := 0; i < 3; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 2, 2), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+	var data bytes.Buffer
+	if err := gif.EncodeAll(&data, g); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		maxPixels int
+		want      int
+	}{
+		{0, 3},
+		{2, 3},
+		{1, 1},
+	} {
+		var out bytes.Buffer
+		err := writeThumbnail(&out, bytes.NewReader(data.Bytes()), "x_thumb.gif", Config{maxPixels: test.maxPixels})
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumb, err := gif.DecodeAll(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(thumb.Image) != test.want {
+			t.Errorf("thumbnail with %d MP limit has %d frames, want %d", test.maxPixels, len(thumb.Image), test.want)
+		}
+	}
+}
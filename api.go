@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	API_PREFIX string = "/api/v1"
+)
+
+var (
+	errNotFound  = &APIError{http.StatusNotFound, "not_found", "No such image"}
+	errForbidden = &APIError{http.StatusForbidden, "forbidden", "Missing or invalid delete key"}
+	errInternal  = &APIError{http.StatusInternalServerError, "internal", "Internal server error"}
+)
+
+// APIError is the structured error body returned by the JSON API.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// ImageDoc is the JSON representation of an Image.
+type ImageDoc struct {
+	UUID         string            `json:"uuid"`
+	URL          string            `json:"url"`
+	ThumbnailURL string            `json:"thumbnail_url"`
+	ViewURL      string            `json:"view_url"`
+	Added        string            `json:"added"`
+	Expires      string            `json:"expires,omitempty"`
+	Unlisted     bool              `json:"unlisted"`
+	Owner        string            `json:"owner,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Frames       int               `json:"frames,omitempty"`
+	DurationMS   int               `json:"duration_ms,omitempty"`
+	Similar      []string          `json:"similar,omitempty"` // UUIDs of earlier images like a new upload
+	DeleteKey    string            `json:"delete_key,omitempty"`
+	DeleteURL    string            `json:"delete_url,omitempty"`
+}
+
+// ImagePatch holds the fields a PATCH request may change. Nil fields are
+// left untouched.
+type ImagePatch struct {
+	Owner    *string `json:"owner"`
+	Unlisted *bool   `json:"unlisted"`
+	Expire   *string `json:"expire"` // "day", "month" or "forever"
+}
+
+func (s *Server) initAPIRoutes() {
+	s.handle("POST", API_PREFIX+"/images", s.APICreateImage)
+	s.handle("GET", API_PREFIX+"/images/:UUID", s.APIGetImage)
+	s.handle("DELETE", API_PREFIX+"/images/:UUID", s.APIDeleteImage)
+	s.handle("PATCH", API_PREFIX+"/images/:UUID", s.APIPatchImage)
+}
+
+func (s *Server) APICreateImage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	image, err := s.saveUpload(w, r)
+	if err != nil {
+		s.writeError(w, toAPIError(err))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/images/%s", API_PREFIX, image.UUID))
+	doc := s.imageDoc(r, image, true)
+	doc.Similar = s.nearDuplicates(r, image)
+	s.writeJSON(w, http.StatusCreated, doc)
+}
+
+func (s *Server) APIGetImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image, err := s.imageDao.Load(params.ByName("UUID"))
+	if err != nil || image == nil {
+		s.writeError(w, errNotFound)
+		return
+	}
+	cookie := r.Context().Value(AppCookie).(string)
+	s.writeJSON(w, http.StatusOK, s.imageDoc(r, image, cookie == image.cookie))
+}
+
+func (s *Server) APIDeleteImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image, apiErr := s.authorizeImage(r, params.ByName("UUID"))
+	if apiErr != nil {
+		s.writeError(w, apiErr)
+		return
+	}
+	orphans, err := s.imageDao.Delete(image)
+	if err != nil {
+		s.logger.Println(err)
+		s.writeError(w, toAPIError(err))
+		return
+	}
+	if err := s.fs.Delete(orphans); err != nil {
+		s.logger.Println(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) APIPatchImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image, apiErr := s.authorizeImage(r, params.ByName("UUID"))
+	if apiErr != nil {
+		s.writeError(w, apiErr)
+		return
+	}
+
+	var patch ImagePatch
+	r.Body = http.MaxBytesReader(w, r.Body, maxPatchSize)
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.writeError(w, &APIError{http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Body exceeds %d bytes", maxPatchSize)})
+		} else {
+			s.writeError(w, &APIError{http.StatusBadRequest, "invalid_json", err.Error()})
+		}
+		return
+	}
+
+	prev := *image
+	if patch.Owner != nil {
+		image.Owner = *patch.Owner
+	}
+	if patch.Unlisted != nil {
+		image.Unlisted = *patch.Unlisted
+	}
+	if patch.Expire != nil {
+		switch *patch.Expire {
+		case "day", "month", "forever":
+			image.Expires = Expiration(*patch.Expire)
+		default:
+			s.writeError(w, &APIError{http.StatusBadRequest, "invalid_expire", "expire must be one of day, month or forever"})
+			return
+		}
+	}
+
+	if err := s.imageDao.Update(image, &prev); err != nil {
+		s.logger.Println(err)
+		s.writeError(w, toAPIError(err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.imageDoc(r, image, true))
+}
+
+// authorizeImage loads the image UUID and checks the request may modify it,
+// either by presenting the delete key, by carrying the uploader's cookie or
+// with an API token allowed to.
+func (s *Server) authorizeImage(r *http.Request, UUID string) (*Image, *APIError) {
+	token, apiErr := s.bearerToken(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	image, err := s.imageDao.Load(UUID)
+	if err != nil || image == nil {
+		return nil, errNotFound
+	}
+	if token != nil {
+		if token.Has(SCOPE_ADMIN) || (token.Has(SCOPE_DELETE_OWN) && image.Token == token.Name) {
+			return image, nil
+		}
+		return nil, errTokenScope
+	}
+	key := r.Header.Get("X-Delete-Key")
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	cookie := r.Context().Value(AppCookie).(string)
+	if key != image.Delete && cookie != image.cookie {
+		return nil, errForbidden
+	}
+	return image, nil
+}
+
+// imageDoc builds the JSON document for image. The delete key is only
+// included when the caller owns the image.
+func (s *Server) imageDoc(r *http.Request, image *Image, owned bool) *ImageDoc {
+	doc := &ImageDoc{
+		UUID:         image.UUID,
+		URL:          absoluteURL(r, "/i/"+image.UUID),
+		ThumbnailURL: absoluteURL(r, "/i/"+image.UUID+"?thumbnail=true"),
+		ViewURL:      absoluteURL(r, "/view/"+image.UUID),
+		Added:        image.Added,
+		Expires:      image.Expires,
+		Unlisted:     image.Unlisted,
+		Owner:        image.Owner,
+		Metadata:     image.Metadata,
+		Frames:       image.Frames,
+		DurationMS:   image.Duration,
+	}
+	if owned {
+		doc.DeleteKey = image.Delete
+		doc.DeleteURL = absoluteURL(r, "/d/"+image.UUID+"/"+image.Delete)
+	}
+	return doc
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Println(err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, e *APIError) {
+	s.writeJSON(w, e.Status, struct {
+		Error *APIError `json:"error"`
+	}{e})
+}
+
+// toAPIError wraps unexpected errors as an internal server error. Their
+// text stays out of the response, callers log it.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var duplicate *DuplicateError
+	if errors.As(err, &duplicate) {
+		return &APIError{http.StatusConflict, "near_duplicate", duplicate.Error()}
+	}
+	return errInternal
+}
+
+// wantsJSON reports whether the client prefers a JSON response over HTML.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// absoluteURL turns path into an absolute URL for the host r was sent to.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// An APNG is a PNG whose frames are described by fcTL chunks. The first
+// frame is usually the IDAT image that viewers without APNG support show,
+// the others are held in fdAT chunks, which image/png skips. Each frame is
+// decoded by wrapping its data in a PNG of its own.
+
+const (
+	APNG_DISPOSE_NONE       byte = 0
+	APNG_DISPOSE_BACKGROUND byte = 1
+	APNG_DISPOSE_PREVIOUS   byte = 2
+	APNG_BLEND_SOURCE       byte = 0
+	APNG_BLEND_OVER         byte = 1
+)
+
+type apng struct {
+	header  []byte   // IHDR
+	palette [][]byte // PLTE and tRNS chunks, with their headers, shared by every frame
+	width   int
+	height  int
+	plays   uint32
+	frames  []*apngFrame
+}
+
+type apngFrame struct {
+	rect     image.Rectangle
+	delayNum uint16
+	delayDen uint16
+	dispose  byte
+	blend    byte
+	data     []byte // zlib stream of the frame's pixels
+}
+
+// parseAPNG splits the APNG in data into its frames, up to max of them if
+// max is not 0.
+func parseAPNG(data []byte, max int) (*apng, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrDecode
+	}
+	a := &apng{}
+	var frame *apngFrame
+	for rest := data[len(pngSignature):]; ; {
+		if len(rest) < 12 {
+			return nil, ErrDecode
+		}
+		n := int(binary.BigEndian.Uint32(rest))
+		if n < 0 || n > len(rest)-12 {
+			return nil, ErrDecode
+		}
+		chunk, body := string(rest[4:8]), rest[8:8+n]
+
+		switch chunk {
+		case "IHDR":
+			if n != 13 {
+				return nil, ErrDecode
+			}
+			a.header = body
+			a.width, a.height = int(binary.BigEndian.Uint32(body)), int(binary.BigEndian.Uint32(body[4:]))
+		case "PLTE", "tRNS":
+			a.palette = append(a.palette, rest[:12+n])
+		case "acTL":
+			if n != 8 {
+				return nil, ErrDecode
+			}
+			a.plays = binary.BigEndian.Uint32(body[4:])
+		case "fcTL":
+			if n != 26 || a.header == nil {
+				return nil, ErrDecode
+			}
+			if max > 0 && len(a.frames) == max {
+				return a, nil
+			}
+			frame = &apngFrame{
+				delayNum: binary.BigEndian.Uint16(body[20:]),
+				delayDen: binary.BigEndian.Uint16(body[22:]),
+				dispose:  body[24],
+				blend:    body[25],
+			}
+			x, y := int(binary.BigEndian.Uint32(body[12:])), int(binary.BigEndian.Uint32(body[16:]))
+			frame.rect = image.Rect(x, y, x+int(binary.BigEndian.Uint32(body[4:])), y+int(binary.BigEndian.Uint32(body[8:])))
+			if frame.rect.Empty() || x < 0 || y < 0 || !frame.rect.In(image.Rect(0, 0, a.width, a.height)) {
+				return nil, ErrDecode
+			}
+			a.frames = append(a.frames, frame)
+		case "IDAT":
+			// Without an fcTL before it, the IDAT image isn't part of the animation.
+			if frame != nil {
+				frame.data = append(frame.data, body...)
+			}
+		case "fdAT":
+			if frame == nil || n < 4 {
+				return nil, ErrDecode
+			}
+			frame.data = append(frame.data, body[4:]...)
+		case "IEND":
+			return a, nil
+		}
+		rest = rest[12+n:]
+	}
+}
+
+// decodeFrame decodes the pixels of frame.
+func (a *apng) decodeFrame(frame *apngFrame) (image.Image, error) {
+	header := append([]byte{}, a.header...)
+	binary.BigEndian.PutUint32(header, uint32(frame.rect.Dx()))
+	binary.BigEndian.PutUint32(header[4:], uint32(frame.rect.Dy()))
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	writePNGChunk(&buf, "IHDR", header)
+	for _, chunk := range a.palette {
+		buf.Write(chunk)
+	}
+	writePNGChunk(&buf, "IDAT", frame.data)
+	writePNGChunk(&buf, "IEND", nil)
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return nil, ErrDecode
+	}
+	return img, nil
+}
+
+// thumbnailAPNG scales down the first max frames of the APNG in data and
+// writes them to w as an APNG.
+func thumbnailAPNG(w io.Writer, data []byte, max int) error {
+	return transformAPNG(w, data, max, thumbnail)
+}
+
+// transformAPNG passes the first max frames of the APNG in data, or all of
+// them if max is 0, through fn and writes them to w as an APNG. Like
+// thumbnailGIF, it draws each frame onto the canvas and transforms the
+// whole canvas, so the new frames replace each other entirely.
+func transformAPNG(w io.Writer, data []byte, max int, fn func(image.Image) image.Image) error {
+	a, err := parseAPNG(data, max)
+	if err != nil {
+		return err
+	}
+	if len(a.frames) == 0 {
+		return ErrDecode
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, a.width, a.height))
+	var bounds image.Rectangle
+	var frames [][]byte
+	for i, frame := range a.frames {
+		img, err := a.decodeFrame(frame)
+		if err != nil {
+			return err
+		}
+		dispose := frame.dispose
+		if dispose == APNG_DISPOSE_PREVIOUS && i == 0 {
+			dispose = APNG_DISPOSE_BACKGROUND
+		}
+		var previous *image.NRGBA
+		if dispose == APNG_DISPOSE_PREVIOUS {
+			previous = imaging.Clone(canvas)
+		}
+
+		op := draw.Src
+		if frame.blend == APNG_BLEND_OVER {
+			op = draw.Over
+		}
+		draw.Draw(canvas, frame.rect, img, img.Bounds().Min, op)
+		out := imaging.Clone(fn(canvas))
+		bounds = out.Bounds()
+		compressed, err := apngData(out)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, compressed)
+
+		switch dispose {
+		case APNG_DISPOSE_BACKGROUND:
+			draw.Draw(canvas, frame.rect, image.Transparent, image.Point{}, draw.Src)
+		case APNG_DISPOSE_PREVIOUS:
+			canvas = previous
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header, uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(header[4:], uint32(bounds.Dy()))
+	header[8], header[9] = 8, 6 // 8 bits a channel, RGBA
+	writePNGChunk(&buf, "IHDR", header)
+	control := make([]byte, 8)
+	binary.BigEndian.PutUint32(control, uint32(len(frames)))
+	binary.BigEndian.PutUint32(control[4:], a.plays)
+	writePNGChunk(&buf, "acTL", control)
+
+	var seq uint32
+	for i, compressed := range frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl, seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:], a.frames[i].delayNum)
+		binary.BigEndian.PutUint16(fctl[22:], a.frames[i].delayDen)
+		fctl[24], fctl[25] = APNG_DISPOSE_NONE, APNG_BLEND_SOURCE
+		writePNGChunk(&buf, "fcTL", fctl)
+		seq++
+		if i == 0 {
+			writePNGChunk(&buf, "IDAT", compressed)
+			continue
+		}
+		fdat := make([]byte, 4, 4+len(compressed))
+		binary.BigEndian.PutUint32(fdat, seq)
+		writePNGChunk(&buf, "fdAT", append(fdat, compressed...))
+		seq++
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// apngData compresses img the way IDAT and fdAT chunks hold it. Each row
+// gets the filter that leaves the smallest sum of absolute differences,
+// the heuristic image/png uses as well.
+func apngData(img *image.NRGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	width := img.Bounds().Dx() * 4
+	prev := make([]byte, width)
+	var filtered [5][]byte
+	for i := range filtered {
+		filtered[i] = make([]byte, 1+width)
+		filtered[i][0] = byte(i)
+	}
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width]
+		best, bestSum := 0, -1
+		for f := range filtered {
+			out, sum := filtered[f][1:], 0
+			for i := range row {
+				var a, c byte
+				if i >= 4 {
+					a, c = row[i-4], prev[i-4]
+				}
+				b := prev[i]
+				switch f {
+				case 0:
+					out[i] = row[i]
+				case 1:
+					out[i] = row[i] - a
+				case 2:
+					out[i] = row[i] - b
+				case 3:
+					out[i] = row[i] - byte((int(a)+int(b))/2)
+				case 4:
+					out[i] = row[i] - paeth(a, b, c)
+				}
+				if d := int(int8(out[i])); d < 0 {
+					sum -= d
+				} else {
+					sum += d
+				}
+			}
+			if bestSum < 0 || sum < bestSum {
+				best, bestSum = f, sum
+			}
+		}
+		if _, err := zw.Write(filtered[best]); err != nil {
+			return nil, err
+		}
+		prev = row
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func writePNGChunk(buf *bytes.Buffer, chunk string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	copy(header[4:], chunk)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	buf.Write(header[:])
+	buf.Write(data)
+	buf.Write(sum[:])
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/unrolled/logger"
+)
+
+// A backup is a tar archive holding, in order, a manifest, a snapshot of
+// the database and the originals and thumbnails it references under data/.
+// Resized copies are left out, they are rendered again on demand. Files
+// deleted while the backup was written are listed in a last entry.
+const (
+	BACKUP_VERSION  int    = 1
+	BACKUP_MANIFEST string = "goimg-backup.json"
+	BACKUP_DB       string = "goimg.db"
+	BACKUP_DATA     string = "data/"
+	BACKUP_SKIPPED  string = "goimg-skipped.json"
+)
+
+var ErrBackupFormat = errors.New("not a goimg backup")
+
+type backupManifest struct {
+	Version int    `json:"version"`
+	Schema  int    `json:"schema"`
+	Created string `json:"created"`
+}
+
+// WriteBackup streams a backup of db and the files it references in
+// storage to w. The database is read in a single transaction, so the
+// snapshot is consistent while the server keeps running. Files deleted
+// after the snapshot was taken, e.g. by GC, are skipped and listed at the
+// end, so a restore can leave out the images they belonged to.
+func WriteBackup(w io.Writer, db *bolt.DB, storage Storage, logger *logger.Logger) error {
+	tw := tar.NewWriter(w)
+	now := time.Now().UTC()
+
+	var keys []string
+	err := db.View(func(tx *bolt.Tx) error {
+		schema := 0
+		if v := tx.Bucket(B(META_BUCKET)).Get(B(SCHEMA_KEY)); v != nil {
+			schema = btoi(v)
+		}
+		manifest, err := json.Marshal(&backupManifest{
+			Version: BACKUP_VERSION,
+			Schema:  schema,
+			Created: now.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+		if err = writeTarFile(tw, BACKUP_MANIFEST, int64(len(manifest)), now, strings.NewReader(string(manifest))); err != nil {
+			return err
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:    BACKUP_DB,
+			Mode:    0600,
+			Size:    tx.Size(),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = tx.WriteTo(tw); err != nil {
+			return err
+		}
+
+		keys = referencedKeys(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var skipped []string
+	for _, key := range keys {
+		err = backupFile(tw, storage, key)
+		if os.IsNotExist(err) {
+			logger.Printf("Backup skipping missing file: %s\n", key)
+			skipped = append(skipped, key)
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(skipped) > 0 {
+		list, err := json.Marshal(skipped)
+		if err != nil {
+			return err
+		}
+		if err = writeTarFile(tw, BACKUP_SKIPPED, int64(len(list)), now, strings.NewReader(string(list))); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// referencedKeys returns the storage keys of every original and thumbnail.
+func referencedKeys(tx *bolt.Tx) []string {
+	seen := make(map[string]bool)
+	bucket := tx.Bucket(B(IMAGE_BUCKET))
+	bucket.ForEach(func(k, v []byte) error {
+		image, err := getImage(bucket, string(k))
+		if err != nil || image == nil {
+			return nil
+		}
+		for _, key := range []string{image.path, image.thumbPath} {
+			if key != "" {
+				seen[path.Base(key)] = true
+			}
+		}
+		return nil
+	})
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func backupFile(tw *tar.Writer, storage Storage, key string) error {
+	info, err := storage.Stat(key)
+	if err != nil {
+		return err
+	}
+	r, err := storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeTarFile(tw, BACKUP_DATA+key, info.Size, info.ModTime, r)
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// Restore reads a backup, optionally gzipped, into an empty database at
+// dbPath and empty storage. It checks that every image's original was
+// restored before moving the database into place, leaving out the images
+// whose original was deleted while the backup was written, and removes
+// what it restored if anything goes wrong.
+func Restore(r io.Reader, dbPath string, storage Storage, logger *logger.Logger) (int, error) {
+	if finfo, err := os.Stat(dbPath); err == nil && finfo.Size() > 0 {
+		return 0, fmt.Errorf("database already exists: %s", dbPath)
+	}
+	err := storage.List(func(key string, info *StorageInfo) error {
+		return fmt.Errorf("storage is not empty, found %s", key)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	r, err = gunzip(r)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dbPath), ".restore-")
+	if err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	restored := make(map[string]bool)
+	skipped := make(map[string]bool)
+	var dropped []string
+	err = restoreArchive(tar.NewReader(r), tmp.Name(), storage, restored, skipped)
+	if err == nil {
+		dropped, err = checkRestore(tmp.Name(), restored, skipped)
+	}
+	if err == nil && len(dropped) > 0 {
+		err = dropImages(tmp.Name(), dropped, storage, restored, logger)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dbPath)
+	}
+	if err != nil {
+		for key := range restored {
+			if derr := storage.Delete(key); derr != nil {
+				logger.Printf("Error removing restored file %s: %s\n", key, derr)
+			}
+		}
+		return 0, err
+	}
+	return len(restored), nil
+}
+
+func restoreArchive(tr *tar.Reader, dbPath string, storage Storage, restored map[string]bool, skipped map[string]bool) error {
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != BACKUP_MANIFEST {
+		return ErrBackupFormat
+	}
+	var manifest backupManifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return ErrBackupFormat
+	}
+	if manifest.Version != BACKUP_VERSION {
+		return fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	if manifest.Schema > SchemaVersion() {
+		return fmt.Errorf("backup schema version %d is newer than supported version %d", manifest.Schema, SchemaVersion())
+	}
+
+	hdr, err = tr.Next()
+	if err != nil || hdr.Name != BACKUP_DB {
+		return ErrBackupFormat
+	}
+	file, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, tr)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Name == BACKUP_SKIPPED {
+			var keys []string
+			if err = json.NewDecoder(tr).Decode(&keys); err != nil {
+				return ErrBackupFormat
+			}
+			for _, key := range keys {
+				skipped[key] = true
+			}
+			continue
+		}
+		key := strings.TrimPrefix(hdr.Name, BACKUP_DATA)
+		if hdr.Typeflag != tar.TypeReg || key == hdr.Name || key != path.Base(key) || strings.HasPrefix(key, ".") {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+		if err = storage.Put(key, tr); err != nil {
+			return err
+		}
+		restored[key] = true
+	}
+}
+
+// gunzip decompresses r if it starts like a gzip stream, so archives can be
+// read as written or compressed.
+func gunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// checkRestore opens the restored database and makes sure every image's
+// original came with it, except those the backup lists as deleted while it
+// was written. It returns the UUIDs of those images. Missing thumbnails
+// are rendered again on demand.
+func checkRestore(dbPath string, restored map[string]bool, skipped map[string]bool) ([]string, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("restored database is unusable: %s", err)
+	}
+	defer db.Close()
+
+	var dropped []string
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(IMAGE_BUCKET))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			image, err := getImage(bucket, string(k))
+			if err != nil {
+				return err
+			}
+			if image == nil || restored[path.Base(image.path)] {
+				return nil
+			}
+			if !skipped[path.Base(image.path)] {
+				return fmt.Errorf("backup is missing the original of image %s: %s", image.UUID, image.path)
+			}
+			dropped = append(dropped, image.UUID)
+			return nil
+		})
+	})
+	return dropped, err
+}
+
+// dropImages deletes the images UUIDs from the restored database, bringing
+// it up to the current schema first, along with any of their files that
+// were restored.
+func dropImages(dbPath string, UUIDs []string, storage Storage, restored map[string]bool, logger *logger.Logger) error {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = Migrate(db, logger); err != nil {
+		return err
+	}
+
+	dao := NewImageDao(db, logger)
+	for _, UUID := range UUIDs {
+		image, err := dao.Load(UUID)
+		if err != nil {
+			return err
+		} else if image == nil {
+			continue
+		}
+		orphans, err := dao.Delete(image)
+		if err != nil {
+			return err
+		}
+		for _, key := range orphans {
+			key = path.Base(key)
+			if !restored[key] {
+				continue
+			}
+			if err = storage.Delete(key); err != nil {
+				return err
+			}
+			delete(restored, key)
+		}
+		logger.Printf("Left out image %s, it was deleted while the backup was written\n", UUID)
+	}
+	return nil
+}
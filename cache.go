@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	CACHE_BUCKET string = "cache"
+)
+
+// Cache tracks derived files (thumbnails and resized variants) that can be
+// regenerated from their original, and evicts the least recently used ones
+// once their total size exceeds a budget.
+//
+// Accesses are collected in memory and written to the cache bucket when the
+// GC runs, so serving an image never needs a write transaction.
+type Cache struct {
+	sync.Mutex
+
+	budget  int64 // bytes, 0 for unlimited
+	pending map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	atime int64 // unix seconds
+	size  int64 // bytes, -1 if unknown
+}
+
+func NewCache(budget int64) *Cache {
+	return &Cache{
+		budget:  budget,
+		pending: make(map[string]cacheEntry),
+	}
+}
+
+// Add records a newly generated file of the given size.
+func (c *Cache) Add(key string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.pending[key] = cacheEntry{atime: time.Now().Unix(), size: size}
+}
+
+// Touch marks key as just used.
+func (c *Cache) Touch(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.pending[key]
+	if !ok {
+		entry.size = -1
+	}
+	entry.atime = time.Now().Unix()
+	c.pending[key] = entry
+}
+
+// Flush writes pending accesses to the cache bucket. Sizes of files not
+// yet known to the cache are looked up in storage.
+func (c *Cache) Flush(tx *bolt.Tx, storage Storage) {
+	c.Lock()
+	pending := c.pending
+	c.pending = make(map[string]cacheEntry)
+	c.Unlock()
+
+	bucket := tx.Bucket(B(CACHE_BUCKET))
+	for key, entry := range pending {
+		if entry.size < 0 {
+			if v := bucket.Get(B(key)); v != nil {
+				entry.size = decodeCacheEntry(v).size
+			} else if info, err := storage.Stat(key); err == nil {
+				entry.size = info.Size
+			} else {
+				continue
+			}
+		}
+		bucket.Put(B(key), encodeCacheEntry(entry))
+	}
+}
+
+// Evict removes the least recently used entries from the cache bucket until
+// the total size fits the budget, and returns their keys so the caller can
+// delete the files.
+func (c *Cache) Evict(tx *bolt.Tx) []string {
+	if c.budget <= 0 {
+		return nil
+	}
+
+	type keyed struct {
+		key string
+		cacheEntry
+	}
+	var entries []keyed
+	var total int64
+	bucket := tx.Bucket(B(CACHE_BUCKET))
+	bucket.ForEach(func(k, v []byte) error {
+		entry := decodeCacheEntry(v)
+		entries = append(entries, keyed{string(k), entry})
+		total += entry.size
+		return nil
+	})
+	if total <= c.budget {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].atime < entries[j].atime
+	})
+	var evicted []string
+	for _, entry := range entries {
+		if total <= c.budget {
+			break
+		}
+		bucket.Delete(B(entry.key))
+		total -= entry.size
+		evicted = append(evicted, entry.key)
+	}
+	return evicted
+}
+
+// forgetCached drops cache entries for keys whose files are being removed.
+func forgetCached(tx *bolt.Tx, keys []string) {
+	bucket := tx.Bucket(B(CACHE_BUCKET))
+	for _, key := range keys {
+		bucket.Delete(B(key))
+	}
+}
+
+func encodeCacheEntry(entry cacheEntry) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(entry.atime))
+	binary.BigEndian.PutUint64(b[8:], uint64(entry.size))
+	return b
+}
+
+func decodeCacheEntry(b []byte) cacheEntry {
+	if len(b) != 16 {
+		return cacheEntry{}
+	}
+	return cacheEntry{
+		atime: int64(binary.BigEndian.Uint64(b)),
+		size:  int64(binary.BigEndian.Uint64(b[8:])),
+	}
+}
+
+// flightGroup collapses concurrent calls for the same key into one, in the
+// spirit of golang.org/x/sync/singleflight. Callers that arrive while a
+// call is running wait for it and share its error.
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+func (g *flightGroup) Do(key string, fn func() error) error {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.Unlock()
+		call.wg.Wait()
+		return call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.Unlock()
+
+	call.err = fn()
+	call.wg.Done()
+
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	return call.err
+}
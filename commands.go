@@ -0,0 +1,617 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Offline commands open the same --db and --data as the server. Bolt allows
+// a single process, so they, and a second server, give up after lockTimeout
+// while the server is running.
+const lockTimeout = time.Second
+
+func newServeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "serve",
+		Short: "Run the web server and periodic GC",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return serve()
+		},
+	}
+}
+
+func newGCCmd() *cobra.Command {
+	var dryRun bool
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Collect garbage once",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			report, err := NewGC(in.db, in.dao, in.fs, &sync.WaitGroup{}, in.logger).Run(dryRun)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Trimmed %d recent entries\n", report.Trimmed)
+			fmt.Printf("Expired %d images\n", len(report.Expired))
+			for _, UUID := range report.Expired {
+				fmt.Println("  " + UUID)
+			}
+			fmt.Printf("Evicted %d cached files\n", report.Evicted)
+			fmt.Printf("Deleted %d files\n", len(report.Deleted))
+			for _, key := range report.Deleted {
+				fmt.Println("  " + key)
+			}
+			if dryRun {
+				fmt.Println("Dry run, nothing was changed")
+			}
+			return nil
+		},
+	}
+	runCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "report what would be collected without changing anything")
+
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Garbage collection",
+	}
+	gcCmd.AddCommand(runCmd)
+	return gcCmd
+}
+
+func newImagesCmd() *cobra.Command {
+	var owner, token string
+	var expired, unlisted bool
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List images",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			now := time.Now().UTC().Format(time.RFC3339)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "UUID\tADDED\tEXPIRES\tOWNER\tLISTED")
+			err = in.dao.ForEach(func(image *Image) error {
+				if owner != "" && image.Owner != owner {
+					return nil
+				}
+				if token != "" && image.Token != token {
+					return nil
+				}
+				if expired && (image.Expires == "" || image.Expires >= now) {
+					return nil
+				}
+				if unlisted && !image.Unlisted {
+					return nil
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", image.UUID, image.Added, orNever(image.Expires), image.Owner, !image.Unlisted)
+				return nil
+			})
+			w.Flush()
+			return err
+		},
+	}
+	lsCmd.Flags().StringVarP(&owner, "owner", "", "", "only images uploaded under this owner")
+	lsCmd.Flags().StringVarP(&token, "token", "", "", "only images uploaded with this API token")
+	lsCmd.Flags().BoolVarP(&expired, "expired", "", false, "only expired images awaiting GC")
+	lsCmd.Flags().BoolVarP(&unlisted, "unlisted", "", false, "only unlisted images")
+
+	showCmd := &cobra.Command{
+		Use:   "show <uuid>",
+		Short: "Show an image's record and stored files",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			image, err := in.dao.Load(args[0])
+			if err != nil {
+				return err
+			} else if image == nil {
+				return fmt.Errorf("Image not found: %s", args[0])
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "UUID:\t%s\n", image.UUID)
+			fmt.Fprintf(w, "Seq:\t%d\n", image.Seq)
+			fmt.Fprintf(w, "Added:\t%s\n", image.Added)
+			fmt.Fprintf(w, "Expires:\t%s\n", orNever(image.Expires))
+			fmt.Fprintf(w, "Unlisted:\t%t\n", image.Unlisted)
+			fmt.Fprintf(w, "Owner:\t%s\n", image.Owner)
+			fmt.Fprintf(w, "Cookie:\t%s\n", image.cookie)
+			fmt.Fprintf(w, "Token:\t%s\n", image.Token)
+			fmt.Fprintf(w, "Delete key:\t%s\n", image.Delete)
+			refs := "untracked" // stored before reference counting
+			if n := in.dao.BlobRefs(image.path); n > 0 {
+				refs = fmt.Sprintf("%d references", n)
+			}
+			fmt.Fprintf(w, "File:\t%s\t%s, %s\n", image.path, in.describe(image.path), refs)
+			fmt.Fprintf(w, "Thumbnail:\t%s\t%s\n", image.thumbPath, in.describe(image.thumbPath))
+			if image.Hash != "" {
+				fmt.Fprintf(w, "Hash:\t%s\n", image.Hash)
+			}
+			if image.Frames > 0 {
+				fmt.Fprintf(w, "Animation:\t%d frames, %s\n", image.Frames, time.Duration(image.Duration)*time.Millisecond)
+			}
+			var names []string
+			for name := range image.Metadata {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(w, "%s:\t%s\n", name, image.Metadata[name])
+			}
+			return w.Flush()
+		},
+	}
+
+	var rmToken string
+	rmCmd := &cobra.Command{
+		Use:   "rm [<uuid>...]",
+		Short: "Delete images and any files no longer referenced",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && rmToken == "" {
+				return errors.New("requires image UUIDs or --token")
+			}
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			if rmToken != "" {
+				err = in.dao.ForEach(func(image *Image) error {
+					if image.Token == rmToken {
+						args = append(args, image.UUID)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			var failed bool
+			for _, UUID := range args {
+				image, err := in.dao.Load(UUID)
+				if err == nil && image == nil {
+					err = errors.New("not found")
+				}
+				if err == nil {
+					var orphans []string
+					if orphans, err = in.dao.Delete(image); err == nil {
+						err = in.fs.Delete(orphans)
+					}
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error deleting %s: %s\n", UUID, err)
+					failed = true
+					continue
+				}
+				fmt.Println("Deleted", UUID)
+			}
+			if failed {
+				return errors.New("Some images were not deleted")
+			}
+			return nil
+		},
+	}
+	rmCmd.Flags().StringVarP(&rmToken, "token", "", "", "also delete every image uploaded with this API token")
+
+	hashCmd := &cobra.Command{
+		Use:   "hash",
+		Short: "Compute the perceptual hashes missing from images uploaded before they were kept",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			var images []*Image
+			err = in.dao.ForEach(func(image *Image) error {
+				if image.Hash == "" {
+					images = append(images, image)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			var hashed, failed int
+			for _, image := range images {
+				prev := *image
+				if image.Hash, err = in.fs.HashImage(image); err == nil {
+					err = in.dao.Update(image, &prev)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error hashing %s: %s\n", image.UUID, err)
+					failed++
+					continue
+				}
+				hashed++
+			}
+			fmt.Printf("Hashed %d images, %d failed\n", hashed, failed)
+			if failed > 0 {
+				return errors.New("Some images were not hashed")
+			}
+			return nil
+		},
+	}
+
+	imagesCmd := &cobra.Command{
+		Use:   "images",
+		Short: "Inspect and delete images",
+	}
+	imagesCmd.AddCommand(lsCmd, showCmd, rmCmd, hashCmd)
+	return imagesCmd
+}
+
+func newTokensCmd() *cobra.Command {
+	token := &Token{}
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an API token and print its secret",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			token.Name = args[0]
+			secret, err := in.dao.CreateToken(token)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Created token", token.Name, "- the secret is shown only once:")
+			fmt.Println(secret)
+			return nil
+		},
+	}
+	createCmd.Flags().StringSliceVarP(&token.Scopes, "scope", "", []string{SCOPE_UPLOAD}, "scopes to grant: upload, delete-own and/or admin")
+	createCmd.Flags().IntVarP(&token.QuotaUploads, "quotauploads", "", 0, "uploads a day allowed with the token, 0 for unlimited")
+	createCmd.Flags().IntVarP(&token.QuotaBytes, "quotabytes", "", 0, "MB a day that may be uploaded with the token, 0 for unlimited")
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List API tokens",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			tokens, err := in.dao.Tokens()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tCREATED\tSCOPES\tUPLOADS/DAY\tMB/DAY")
+			for _, t := range tokens {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, t.Created, strings.Join(t.Scopes, ","), orUnlimited(t.QuotaUploads), orUnlimited(t.QuotaBytes))
+			}
+			return w.Flush()
+		},
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <name>...",
+		Short: "Revoke API tokens",
+		Long:  "Revoke API tokens. Images uploaded with them are kept, see images rm --token.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			for _, name := range args {
+				if err = in.dao.RevokeToken(name); err != nil {
+					return fmt.Errorf("%s: %s", name, err)
+				}
+				fmt.Println("Revoked", name)
+			}
+			return nil
+		},
+	}
+
+	tokensCmd := &cobra.Command{
+		Use:   "tokens",
+		Short: "Manage API tokens",
+	}
+	tokensCmd.AddCommand(createCmd, lsCmd, revokeCmd)
+	return tokensCmd
+}
+
+func newStatsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "stats",
+		Short: "Summarize the database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			stats, err := in.dao.Stats()
+			if err != nil {
+				return err
+			}
+			var dbSize int64
+			if finfo, err := os.Stat(cfg.db); err == nil {
+				dbSize = finfo.Size()
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "Database:\t%s (%d bytes, schema version %d)\n", cfg.db, dbSize, stats.Schema)
+			fmt.Fprintf(w, "Images:\t%d\n", stats.Images)
+			fmt.Fprintf(w, "Unlisted:\t%d\n", stats.Unlisted)
+			fmt.Fprintf(w, "Expiring:\t%d\n", stats.Expiring)
+			fmt.Fprintf(w, "Expired:\t%d\n", stats.Expired)
+			fmt.Fprintf(w, "Owners:\t%d\n", stats.Owners)
+			fmt.Fprintf(w, "Stored files:\t%d\n", stats.Blobs)
+			fmt.Fprintf(w, "Resized copies:\t%d\n", stats.Derivatives)
+			fmt.Fprintf(w, "Cached files:\t%d (%d bytes)\n", stats.Cached, stats.CachedBytes)
+			return w.Flush()
+		},
+	}
+}
+
+func newFsckCmd() *cobra.Command {
+	var repair bool
+	fsckCmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Check the database against stored files",
+		Long: `Check the database against stored files and report orphan files,
+images whose original is missing, missing thumbnails, and recent and
+expiration entries that don't match their image. With --repair, images
+without an original are deleted, missing thumbnails are dropped from the
+cache, to be rendered again on request, and entries are fixed. Orphans are
+deleted from the data directory, but from S3 only under --s3prefix, as a
+shared bucket may hold other instances' files.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			issues, err := NewFsck(in.db, in.dao, in.fs, in.logger).Run(repair)
+			if err != nil {
+				return err
+			}
+			for _, issue := range issues {
+				fmt.Println(issue)
+			}
+			if len(issues) > 0 && !repair {
+				return fmt.Errorf("%d problems found, run with --repair to fix them", len(issues))
+			}
+			fmt.Printf("%d problems found\n", len(issues))
+			return nil
+		},
+	}
+	fsckCmd.Flags().BoolVarP(&repair, "repair", "", false, "fix what is found")
+	return fsckCmd
+}
+
+func newBackupCmd() *cobra.Command {
+	var output string
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Write a backup archive of the database and images",
+		Long: `Write a tar archive holding a snapshot of the database and every original
+and thumbnail it references. The server holds the database lock, so back up
+a running instance through GET /admin/backup instead.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			if output == "-" {
+				return WriteBackup(os.Stdout, in.db, in.fs.storage, in.logger)
+			}
+			file, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			err = WriteBackup(file, in.db, in.fs.storage, in.logger)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(output)
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Wrote backup:", output)
+			return nil
+		},
+	}
+	backupCmd.Flags().StringVarP(&output, "output", "o", "-", "file to write, - for standard output")
+	return backupCmd
+}
+
+func newRestoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <archive>",
+		Short: "Restore a backup archive into an empty database and data directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := checkPaths(); err != nil {
+				return err
+			}
+			storage, err := NewStorage(cfg)
+			if err != nil {
+				return err
+			}
+
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				r = file
+			}
+			n, err := Restore(r, cfg.db, storage, newLogger(os.Stderr))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Restored %s and %d files\n", cfg.db, n)
+			return nil
+		},
+	}
+}
+
+func newExportCmd() *cobra.Command {
+	var output string
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write every image and its metadata to a portable archive",
+		Long: `Write a tar archive holding a manifest of image metadata, one JSON record
+per line, and the original files, for "goimg import" on another instance.
+Export a running instance through GET /admin/export instead.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			if output == "-" {
+				_, err = WriteExport(os.Stdout, in.dao, in.fs.storage, in.logger)
+				return err
+			}
+			file, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			n, err := WriteExport(file, in.dao, in.fs.storage, in.logger)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(output)
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Exported %d images: %s\n", n, output)
+			return nil
+		},
+	}
+	exportCmd.Flags().StringVarP(&output, "output", "o", "-", "file to write, - for standard output")
+	return exportCmd
+}
+
+func newImportCmd() *cobra.Command {
+	var collision string
+	importCmd := &cobra.Command{
+		Use:   "import <archive>",
+		Short: "Add the images from an export archive",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			in, err := open(lockTimeout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				r = file
+			}
+			report, err := Import(r, in.dao, in.fs, collision, in.logger)
+			if report != nil {
+				fmt.Print(report)
+			}
+			if err == nil && len(report.Missing) > 0 {
+				err = fmt.Errorf("%d images could not be imported", len(report.Missing))
+			}
+			return err
+		},
+	}
+	importCmd.Flags().StringVarP(&collision, "collision", "", COLLISION_SKIP, "what to do with an image whose UUID is taken: skip, fail or rename")
+	return importCmd
+}
+
+// describe returns the size of the stored file key, or why it can't.
+func (in *instance) describe(key string) string {
+	if key == "" {
+		return "none"
+	}
+	info, err := in.fs.storage.Stat(key)
+	if os.IsNotExist(err) {
+		return "missing"
+	} else if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d bytes", info.Size)
+}
+
+func orUnlimited(n int) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(n)
+}
+
+func orNever(expires string) string {
+	if expires == "" {
+		return "never"
+	}
+	return expires
+}
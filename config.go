@@ -6,4 +6,59 @@ type Config struct {
 	db         string
 	gcInterval int // Seconds, default 300s
 	gcLimit    int // Number of entries to scan each gc, default 100
+
+	shutdownTimeout int // Seconds to drain requests on SIGINT/SIGTERM, default 30
+
+	adminToken string // Bearer token for /admin endpoints, empty disables them
+
+	cookieKeys   string // Comma separated keys for signing cookies, the first signs
+	cookieSecure bool   // Always mark cookies Secure, not just on HTTPS requests
+
+	legacyCookies string // Last day, YYYY-MM-DD, unsigned cookies are accepted once, empty refuses them
+
+	minFreeSpace int // MB free in the data directory for /readyz to pass, default 100
+
+	trustedProxies string // Comma separated addresses or CIDR ranges whose X-Forwarded-For is believed
+
+	// Upload limits per client address and per cookie, 0 disables each
+	uploadRate   int // Uploads a minute, default 10
+	uploadBurst  int // Uploads at once before the rate applies, default 10
+	quotaUploads int // Uploads a day
+	quotaBytes   int // MB uploaded a day
+
+	fsckInterval int  // Seconds between background consistency checks, 0 disables
+	fsckRepair   bool // Repair what the background check finds
+
+	recentPageSize  int // Images per page of /recent, default 20
+	recentRetention int // Images kept in the recent listing, default 1000
+
+	// Allow-lists for /i/:UUID variants, comma separated
+	sizes     string // WxH, 0 leaves a side unconstrained
+	qualities string
+
+	// Limits checked before decoding images, 0 disables each
+	maxWidth  int // Pixels, default 16384
+	maxHeight int // Pixels, default 16384
+	maxPixels int // Megapixels, default 50
+	maxFrames int // GIF animation frames, default 500
+
+	stripMetadata bool // Strip EXIF, XMP and IPTC from uploads and apply their orientation
+	keepMetadata  bool // Keep camera settings from the stripped metadata for display
+
+	webp bool // Offer lossless WebP copies of thumbnails and resized images
+
+	duplicates      string // What to do with uploads like an earlier image: allow, warn or redirect
+	similarDistance int    // Most bits of 64 in which hashes of similar images differ, default 10
+
+	cacheSize int // MB of thumbnails and variants to keep, 0 for unlimited
+
+	// Storage backend, "disk" (default) or "s3"
+	storage     string
+	s3Endpoint  string
+	s3Bucket    string
+	s3Region    string
+	s3AccessKey string
+	s3SecretKey string
+	s3PathStyle bool   // Address buckets as endpoint/bucket, as MinIO expects
+	s3Prefix    string // Key prefix keeping this instance's objects apart in a shared bucket
 }
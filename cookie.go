@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// Generated cookie key, used when none is configured
+	COOKIE_KEY string = "cookiekey"
+
+	MIN_COOKIE_KEY int = 16
+
+	// Unsigned cookies from before signing that were signed once
+	LEGACY_COOKIE_BUCKET string = "legacycookies"
+
+	// Format of the last day unsigned cookies are accepted
+	LEGACY_COOKIE_DATE string = "2006-01-02"
+)
+
+var ErrUnsignedCookie = errors.New("unsigned cookie")
+
+// CookieSigner signs goimg cookies so clients can't make up the value of
+// somebody else's cookie. Values are "id.signature", where the signature
+// is an HMAC-SHA256 of the id. The first key signs and every key verifies,
+// so a new key can be put in front while the old one is phased out.
+type CookieSigner struct {
+	keys [][]byte
+
+	// Unsigned cookies from before signing are accepted until then, zero
+	// refuses them
+	legacyUntil time.Time
+}
+
+// NewCookieSigner uses the comma separated keys, or if there are none a
+// key generated once and kept in the database. Unsigned cookies are
+// accepted until the end of the day legacyUntil, if it isn't empty.
+func NewCookieSigner(keys string, legacyUntil string, dao *ImageDao) (*CookieSigner, error) {
+	signer := &CookieSigner{}
+	if legacyUntil != "" {
+		day, err := time.Parse(LEGACY_COOKIE_DATE, legacyUntil)
+		if err != nil {
+			return nil, fmt.Errorf("legacy cookie date must look like %s: %s", LEGACY_COOKIE_DATE, legacyUntil)
+		}
+		signer.legacyUntil = day.AddDate(0, 0, 1)
+	}
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if len(key) < MIN_COOKIE_KEY {
+			return nil, fmt.Errorf("cookie keys must be at least %d characters", MIN_COOKIE_KEY)
+		}
+		signer.keys = append(signer.keys, B(key))
+	}
+	if len(signer.keys) > 0 {
+		return signer, nil
+	}
+
+	key, err := dao.CookieKey()
+	if err != nil {
+		return nil, err
+	}
+	signer.keys = [][]byte{key}
+	return signer, nil
+}
+
+// Sign returns the cookie value for id.
+func (cs *CookieSigner) Sign(id string) string {
+	return id + "." + cs.mac(cs.keys[0], id)
+}
+
+// Verify returns the id in a signed cookie value, and whether it was signed
+// with the current key.
+func (cs *CookieSigner) Verify(value string) (string, bool, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 1 {
+		return "", false, ErrUnsignedCookie
+	}
+	id, sig := value[:i], value[i+1:]
+	for n, key := range cs.keys {
+		if hmac.Equal([]byte(sig), []byte(cs.mac(key, id))) {
+			return id, n == 0, nil
+		}
+	}
+	return "", false, errors.New("bad cookie signature")
+}
+
+// AcceptsLegacy reports whether unsigned cookies from before signing may
+// still be claimed.
+func (cs *CookieSigner) AcceptsLegacy() bool {
+	return time.Now().Before(cs.legacyUntil)
+}
+
+func (cs *CookieSigner) mac(key []byte, id string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(B(id))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// CookieKey returns the generated cookie key, creating it on first use.
+func (dao *ImageDao) CookieKey() ([]byte, error) {
+	var key []byte
+	err := dao.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(B(META_BUCKET))
+		if v := meta.Get(B(COOKIE_KEY)); v != nil {
+			key = append([]byte{}, v...)
+			return nil
+		}
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		return meta.Put(B(COOKIE_KEY), key)
+	})
+	return key, err
+}
+
+// ClaimLegacyCookie reports whether id, the value of an unsigned cookie
+// from before signing, uploaded images and hasn't been claimed before. It
+// marks id claimed, so the unsigned value is accepted once and then only
+// its signed replacement. Values that can't be claimed are turned away in
+// a read transaction, so made up cookies don't cost a write each.
+func (dao *ImageDao) ClaimLegacyCookie(id string) (bool, error) {
+	claimable := func(tx *bolt.Tx) bool {
+		return tx.Bucket(B(COOKIE_INDEX_BUCKET)).Bucket(B(id)) != nil &&
+			tx.Bucket(B(LEGACY_COOKIE_BUCKET)).Get(B(id)) == nil
+	}
+	claimed := false
+	err := dao.db.View(func(tx *bolt.Tx) error {
+		claimed = claimable(tx)
+		return nil
+	})
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	err = dao.db.Update(func(tx *bolt.Tx) error {
+		// Another request may have claimed it in between.
+		if claimed = claimable(tx); !claimed {
+			return nil
+		}
+		return tx.Bucket(B(LEGACY_COOKIE_BUCKET)).Put(B(id), B(time.Now().UTC().Format(time.RFC3339)))
+	})
+	return claimed, err
+}
+
+// setCookie issues the signed cookie for id. It is only sent over HTTPS
+// when the request came in that way, directly or through a proxy, or when
+// configured to.
+func (s *Server) setCookie(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AppCookie,
+		Value:    s.signer.Sign(id),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.config.cookieSecure || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+	})
+}
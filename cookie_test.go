@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	testCookieKey    string = "0123456789abcdef-new"
+	testOldCookieKey string = "0123456789abcdef-old"
+)
+
+func TestCookieSignerVerify(t *testing.T) {
+	current, err := NewCookieSigner(testCookieKey+","+testOldCookieKey, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := NewCookieSigner(testOldCookieKey, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCookieSigner("another key of 16 chars", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := current.Sign("abc")
+	flipped := byte('A')
+	if signed[len(signed)-1] == flipped {
+		flipped = 'B'
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		wantID      string
+		wantCurrent bool
+		wantErr     bool
+	}{
+		{"current key", signed, "abc", true, false},
+		{"rotated key", old.Sign("abc"), "abc", false, false},
+		{"unknown key", other.Sign("abc"), "", false, true},
+		{"forged id", "abd" + signed[3:], "", false, true},
+		{"forged signature", signed[:len(signed)-1] + string(flipped), "", false, true},
+		{"no signature", "abc.", "", false, true},
+		{"id with a dot", current.Sign("a.b"), "a.b", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, isCurrent, err := current.Verify(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if id != test.wantID || isCurrent != test.wantCurrent {
+				t.Errorf("Verify = %q, %v, want %q, %v", id, isCurrent, test.wantID, test.wantCurrent)
+			}
+		})
+	}
+
+	if _, _, err = current.Verify("abc"); err != ErrUnsignedCookie {
+		t.Errorf("unsigned cookie gave %v, want ErrUnsignedCookie", err)
+	}
+	if _, err = NewCookieSigner("short", "", nil); err == nil {
+		t.Error("accepted a short key")
+	}
+}
+
+func TestCookieSignerGeneratedKey(t *testing.T) {
+	dao := newTestDao(t)
+	first, err := NewCookieSigner(" , ", "", dao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewCookieSigner("", "", dao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, current, err := second.Verify(first.Sign("abc")); err != nil || !current {
+		t.Errorf("generated key not kept: %v", err)
+	}
+}
+
+func TestLegacyCookies(t *testing.T) {
+	dao := newTestDao(t)
+	if _, err := NewCookieSigner(testCookieKey, "31/12/2020", dao); err == nil {
+		t.Error("accepted a badly formatted date")
+	}
+	tests := []struct {
+		until string
+		want  bool
+	}{
+		{"", false},
+		{"2020-12-31", false},
+		{time.Now().UTC().Format(LEGACY_COOKIE_DATE), true},
+		{time.Now().AddDate(0, 1, 0).Format(LEGACY_COOKIE_DATE), true},
+	}
+	for _, test := range tests {
+		signer, err := NewCookieSigner(testCookieKey, test.until, dao)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := signer.AcceptsLegacy(); got != test.want {
+			t.Errorf("AcceptsLegacy until %q = %v, want %v", test.until, got, test.want)
+		}
+	}
+
+	// Only a cookie that uploaded images can be claimed, and only once.
+	err := dao.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(B(COOKIE_INDEX_BUCKET)).CreateBucket(B("uploader"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		claimed, err := dao.ClaimLegacyCookie("uploader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != want {
+			t.Errorf("claim %d = %v, want %v", i+1, claimed, want)
+		}
+	}
+	if claimed, _ := dao.ClaimLegacyCookie(strings.Repeat("x", 9)); claimed {
+		t.Error("claimed a cookie that never uploaded")
+	}
+}
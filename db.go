@@ -2,7 +2,13 @@ package main
 
 import (
 	"bytes"
-	"strconv"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/unrolled/logger"
@@ -12,9 +18,14 @@ const (
 	IMAGE_BUCKET      string = "images"
 	EXPIRATION_BUCKET string = "expiration"
 	RECENT_BUCKET     string = "recent"
-	RECENT_LIMIT      int    = 5
+	BLOB_BUCKET       string = "blobs"
+	DERIVATIVE_BUCKET string = "derivatives"
+
+	IMAGE_RECORD_VERSION int = 1
 )
 
+var ErrImageExists = errors.New("an image with this UUID already exists")
+
 type ImageDao struct {
 	db     *bolt.DB
 	logger *logger.Logger
@@ -27,53 +38,210 @@ func NewImageDao(db *bolt.DB, logger *logger.Logger) *ImageDao {
 	}
 }
 
+// Save stores a new image. It fails with ErrImageExists rather than
+// overwrite another image with the same UUID.
 func (dao *ImageDao) Save(image *Image) error {
 	err := dao.db.Update(func(tx *bolt.Tx) error {
-		var bucket *bolt.Bucket
+		if tx.Bucket(B(IMAGE_BUCKET)).Get(B(image.UUID)) != nil {
+			return ErrImageExists
+		}
 
 		if !image.Unlisted {
 			// Add image to public listing
-			bucket = tx.Bucket(B(RECENT_BUCKET))
-			id, err := bucket.NextSequence()
-			if err != nil {
+			if err := dao.addRecent(image, tx); err != nil {
 				return err
 			}
-			bucket.Put(itob(int(id)), B(image.UUID))
-			image.RecentKey = itob(int(id))
 		}
 
 		if image.Expires != "" {
-			// Get today
-			bucket = tx.Bucket(B(EXPIRATION_BUCKET))
-			today := bucket.Get(B(image.Expires))
-			if today == nil || string(today) == "" {
-				// We're creating a new entry
-				today = B(image.UUID)
-			} else {
-				// Append to existing entry
-				today = append(today, ',')
-				today = append(today, B(image.UUID)...)
+			addExpiration(tx, image.Expires, image.UUID)
+		}
+
+		if err := addBlobRef(tx, image.path); err != nil {
+			return err
+		}
+
+		if image.Seq == 0 {
+			seq, err := tx.Bucket(B(IMAGE_BUCKET)).NextSequence()
+			if err != nil {
+				return err
 			}
-			bucket.Put(B(image.Expires), today)
+			image.Seq = int(seq)
+		}
+		if err := addToIndexes(tx, image); err != nil {
+			return err
 		}
 
-		bucket = tx.Bucket(B(IMAGE_BUCKET))
-		bucket.Put(B(image.UUID+":path"), B(image.path))
-		bucket.Put(B(image.UUID+":thumbpath"), B(image.thumbPath))
-		bucket.Put(B(image.UUID+":added"), B(image.Added))
-		bucket.Put(B(image.UUID+":expires"), B(image.Expires))
-		bucket.Put(B(image.UUID+":delete"), B(image.Delete))
-		bucket.Put(B(image.UUID+":unlisted"), B(strconv.FormatBool(image.Unlisted)))
-		bucket.Put(B(image.UUID+":cookie"), B(image.cookie))
-		bucket.Put(B(image.UUID+":owner"), B(image.Owner))
-		bucket.Put(B(image.UUID+":recentkey"), image.RecentKey)
+		return putImage(tx.Bucket(B(IMAGE_BUCKET)), image)
+	})
 
-		return nil
+	return err
+}
+
+// Update rewrites an existing image record, moving its recent, expiration
+// and owner index entries if they changed since prev was loaded.
+func (dao *ImageDao) Update(image *Image, prev *Image) error {
+	err := dao.db.Update(func(tx *bolt.Tx) error {
+		if prev.Unlisted != image.Unlisted {
+			if image.Unlisted {
+				tx.Bucket(B(RECENT_BUCKET)).Delete(image.RecentKey)
+				image.RecentKey = nil
+			} else if err := dao.addRecent(image, tx); err != nil {
+				return err
+			}
+		}
+
+		if prev.Expires != image.Expires {
+			if prev.Expires != "" {
+				removeExpiration(tx, prev.Expires, image.UUID)
+			}
+			if image.Expires != "" {
+				addExpiration(tx, image.Expires, image.UUID)
+			}
+		}
+
+		if prev.Owner != image.Owner {
+			if err := indexDelete(tx, OWNER_INDEX_BUCKET, prev.Owner, prev); err != nil {
+				return err
+			}
+			if err := indexPut(tx, OWNER_INDEX_BUCKET, image.Owner, image); err != nil {
+				return err
+			}
+		}
+
+		return putImage(tx.Bucket(B(IMAGE_BUCKET)), image)
 	})
 
 	return err
 }
 
+func (dao *ImageDao) addRecent(image *Image, tx *bolt.Tx) error {
+	bucket := tx.Bucket(B(RECENT_BUCKET))
+	id, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	bucket.Put(itob(int(id)), B(image.UUID))
+	image.RecentKey = itob(int(id))
+	return nil
+}
+
+// imageRecord is how an Image is stored, as JSON under its UUID in the
+// image bucket. Version is bumped whenever the meaning of a field changes.
+type imageRecord struct {
+	Version   int               `json:"v"`
+	UUID      string            `json:"uuid"`
+	Seq       int               `json:"seq"`
+	Path      string            `json:"path"`
+	ThumbPath string            `json:"thumbpath"`
+	Added     string            `json:"added"`
+	Expires   string            `json:"expires,omitempty"`
+	Delete    string            `json:"delete"`
+	Unlisted  bool              `json:"unlisted"`
+	Cookie    string            `json:"cookie,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Token     string            `json:"token,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Frames    int               `json:"frames,omitempty"`
+	Duration  int               `json:"duration,omitempty"`
+	Hash      string            `json:"dhash,omitempty"`
+	RecentKey []byte            `json:"recentkey,omitempty"`
+}
+
+func putImage(bucket *bolt.Bucket, image *Image) error {
+	v, err := json.Marshal(&imageRecord{
+		Version:   IMAGE_RECORD_VERSION,
+		UUID:      image.UUID,
+		Seq:       image.Seq,
+		Path:      image.path,
+		ThumbPath: image.thumbPath,
+		Added:     image.Added,
+		Expires:   image.Expires,
+		Delete:    image.Delete,
+		Unlisted:  image.Unlisted,
+		Cookie:    image.cookie,
+		Owner:     image.Owner,
+		Token:     image.Token,
+		Metadata:  image.Metadata,
+		Frames:    image.Frames,
+		Duration:  image.Duration,
+		Hash:      image.Hash,
+		RecentKey: image.RecentKey,
+	})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(B(image.UUID), v)
+}
+
+// getImage decodes the record stored under UUID, returning nil if there is
+// none.
+func getImage(bucket *bolt.Bucket, UUID string) (*Image, error) {
+	v := bucket.Get(B(UUID))
+	if v == nil {
+		return nil, nil
+	}
+	var record imageRecord
+	if err := json.Unmarshal(v, &record); err != nil {
+		return nil, fmt.Errorf("corrupt image record %s: %s", UUID, err)
+	}
+	return &Image{
+		UUID:      record.UUID,
+		Seq:       record.Seq,
+		path:      record.Path,
+		thumbPath: record.ThumbPath,
+		Added:     record.Added,
+		Unlisted:  record.Unlisted,
+		Expires:   record.Expires,
+		Delete:    record.Delete,
+		cookie:    record.Cookie,
+		Owner:     record.Owner,
+		Token:     record.Token,
+		Metadata:  record.Metadata,
+		Frames:    record.Frames,
+		Duration:  record.Duration,
+		Hash:      record.Hash,
+		RecentKey: record.RecentKey,
+	}, nil
+}
+
+// addExpiration appends UUID to the comma separated list of images
+// expiring at the given time.
+func addExpiration(tx *bolt.Tx, expires string, UUID string) {
+	bucket := tx.Bucket(B(EXPIRATION_BUCKET))
+	entry := bucket.Get(B(expires))
+	if entry == nil || string(entry) == "" {
+		// We're creating a new entry
+		entry = B(UUID)
+	} else {
+		// Append to existing entry
+		entry = append(append([]byte{}, entry...), ',')
+		entry = append(entry, B(UUID)...)
+	}
+	bucket.Put(B(expires), entry)
+}
+
+// removeExpiration drops UUID from the list of images expiring at the
+// given time, removing the entry entirely once it is empty.
+func removeExpiration(tx *bolt.Tx, expires string, UUID string) {
+	bucket := tx.Bucket(B(EXPIRATION_BUCKET))
+	entry := bucket.Get(B(expires))
+	if entry == nil {
+		return
+	}
+	var keep []string
+	for _, uuid := range strings.Split(string(entry), ",") {
+		if uuid != UUID && uuid != "" {
+			keep = append(keep, uuid)
+		}
+	}
+	if len(keep) == 0 {
+		bucket.Delete(B(expires))
+		return
+	}
+	bucket.Put(B(expires), B(strings.Join(keep, ",")))
+}
+
 func (dao *ImageDao) Load(UUID string) (*Image, error) {
 	var image *Image
 	err := dao.db.View(func(tx *bolt.Tx) error {
@@ -81,80 +249,253 @@ func (dao *ImageDao) Load(UUID string) (*Image, error) {
 		if bucket == nil {
 			return nil
 		}
-		image = dao.BucketToImage(UUID, bucket)
-		return nil
+		var err error
+		image, err = getImage(bucket, UUID)
+		return err
 	})
 
 	return image, err
 }
 
-func (dao *ImageDao) DeleteWithTx(image *Image, tx *bolt.Tx) error {
-	imageBucket := tx.Bucket(B(IMAGE_BUCKET))
-	c := imageBucket.Cursor()
-	k, _ := c.Seek(B(image.UUID))
-	if k == nil {
-		dao.logger.Printf("Error locating image: %s\n", image.UUID)
+// Animated returns which of the images are animated.
+func (dao *ImageDao) Animated(UUIDs []string) map[string]bool {
+	animated := make(map[string]bool)
+	dao.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(IMAGE_BUCKET))
+		for _, UUID := range UUIDs {
+			if image, err := getImage(bucket, UUID); err == nil && image != nil && image.Frames > 1 {
+				animated[UUID] = true
+			}
+		}
 		return nil
+	})
+	return animated
+}
+
+// ForEach calls fn for every stored image in upload order, stopping at the
+// first error.
+func (dao *ImageDao) ForEach(fn func(*Image) error) error {
+	var images []*Image
+	err := dao.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(IMAGE_BUCKET))
+		return bucket.ForEach(func(k, v []byte) error {
+			image, err := getImage(bucket, string(k))
+			if err != nil {
+				return err
+			}
+			images = append(images, image)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
 	}
 
-	for ; k != nil && bytes.HasPrefix(k, B(image.UUID)); k, _ = c.Next() {
-		// Delete image keys
-		c.Delete()
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Seq < images[j].Seq
+	})
+	for _, image := range images {
+		if err = fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats summarizes the contents of the database.
+type Stats struct {
+	Schema      int
+	Images      int
+	Unlisted    int
+	Expiring    int   // images with an expiration date
+	Expired     int   // expired images awaiting GC
+	Owners      int   // distinct owner names
+	Blobs       int   // distinct stored originals
+	Derivatives int   // rendered variants on record
+	Cached      int   // thumbnails and variants tracked by the cache
+	CachedBytes int64 // their total size as last flushed by GC
+}
+
+func (dao *ImageDao) Stats() (*Stats, error) {
+	stats := &Stats{}
+	now := time.Now().UTC().Format(time.RFC3339)
+	err := dao.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(B(META_BUCKET)).Get(B(SCHEMA_KEY)); v != nil {
+			stats.Schema = btoi(v)
+		}
+
+		bucket := tx.Bucket(B(IMAGE_BUCKET))
+		err := bucket.ForEach(func(k, v []byte) error {
+			image, err := getImage(bucket, string(k))
+			if err != nil {
+				return err
+			}
+			stats.Images++
+			if image.Unlisted {
+				stats.Unlisted++
+			}
+			if image.Expires != "" {
+				stats.Expiring++
+				if image.Expires < now {
+					stats.Expired++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		tx.Bucket(B(OWNER_INDEX_BUCKET)).ForEach(func(k, v []byte) error {
+			stats.Owners++
+			return nil
+		})
+		stats.Blobs = tx.Bucket(B(BLOB_BUCKET)).Stats().KeyN
+		stats.Derivatives = tx.Bucket(B(DERIVATIVE_BUCKET)).Stats().KeyN
+		return tx.Bucket(B(CACHE_BUCKET)).ForEach(func(k, v []byte) error {
+			stats.Cached++
+			stats.CachedBytes += decodeCacheEntry(v).size
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// DeleteWithTx removes image from the database. It returns the storage
+// keys that are no longer referenced by any image: the original, its
+// thumbnail and derivatives when image held the last reference to its
+// stored file, otherwise none.
+func (dao *ImageDao) DeleteWithTx(image *Image, tx *bolt.Tx) ([]string, error) {
+	imageBucket := tx.Bucket(B(IMAGE_BUCKET))
+	if imageBucket.Get(B(image.UUID)) == nil {
+		dao.logger.Printf("Error locating image: %s\n", image.UUID)
+		return nil, nil
+	}
+	if err := imageBucket.Delete(B(image.UUID)); err != nil {
+		return nil, err
 	}
 
 	recent := tx.Bucket(B(RECENT_BUCKET))
 	recent.Delete(image.RecentKey)
-	return nil
+
+	if err := removeFromIndexes(tx, image); err != nil {
+		return nil, err
+	}
+
+	last, err := releaseBlobRef(tx, image.path)
+	if err != nil || !last {
+		return nil, err
+	}
+	orphans := []string{image.path, image.thumbPath}
+	orphans = append(orphans, removeDerivatives(tx, image.path)...)
+	forgetCached(tx, orphans)
+	return orphans, nil
 }
 
-func (dao *ImageDao) Delete(image *Image) error {
+// Delete removes image from the database, see DeleteWithTx.
+func (dao *ImageDao) Delete(image *Image) ([]string, error) {
+	var orphans []string
 	err := dao.db.Update(func(tx *bolt.Tx) error {
-		return dao.DeleteWithTx(image, tx)
+		var err error
+		orphans, err = dao.DeleteWithTx(image, tx)
+		return err
 	})
-	return err
+	return orphans, err
 }
 
-func (dao *ImageDao) ListRecent() []string {
-	recent := make([]string, RECENT_LIMIT)
+// BlobRefs returns the number of images referencing the stored file key.
+func (dao *ImageDao) BlobRefs(key string) int {
+	var refs int
 	dao.db.View(func(tx *bolt.Tx) error {
-		var index = 0
+		refs = blobRefs(tx, key)
+		return nil
+	})
+	return refs
+}
 
-		recentBucket := tx.Bucket(B(RECENT_BUCKET))
-		c := recentBucket.Cursor()
+func blobRefs(tx *bolt.Tx, key string) int {
+	v := tx.Bucket(B(BLOB_BUCKET)).Get(B(key))
+	if v == nil {
+		return 0
+	}
+	return btoi(v)
+}
 
-		for k, v := c.Last(); index < RECENT_LIMIT; k, v = c.Prev() {
-			if k == nil {
-				index++
-			}
-			if k != nil && v != nil {
-				recent[index] = string(v)
-				index++
-			}
+// addBlobRef records one more image referencing the stored file key.
+func addBlobRef(tx *bolt.Tx, key string) error {
+	return tx.Bucket(B(BLOB_BUCKET)).Put(B(key), itob(blobRefs(tx, key)+1))
+}
+
+// releaseBlobRef drops one reference to the stored file key and reports
+// whether it was the last. Files saved before reference counting have no
+// entry and are owned by a single image.
+func releaseBlobRef(tx *bolt.Tx, key string) (bool, error) {
+	bucket := tx.Bucket(B(BLOB_BUCKET))
+	refs := blobRefs(tx, key)
+	if refs <= 1 {
+		return true, bucket.Delete(B(key))
+	}
+	return false, bucket.Put(B(key), itob(refs-1))
+}
+
+// AddDerivative records that key, of size bytes, was rendered from the
+// stored file blobKey, so it is removed along with it.
+func (dao *ImageDao) AddDerivative(blobKey string, key string, size int64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(size))
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(B(DERIVATIVE_BUCKET)).Put(B(blobKey+"/"+key), v)
+	})
+}
+
+// DerivativeSize returns the size recorded for the derivative key of the
+// stored file blobKey, and whether there is one.
+func (dao *ImageDao) DerivativeSize(blobKey string, key string) (int64, bool) {
+	var size int64
+	var known bool
+	dao.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(B(DERIVATIVE_BUCKET)).Get(B(blobKey + "/" + key))
+		if len(v) == 8 {
+			size, known = int64(binary.BigEndian.Uint64(v)), true
 		}
 		return nil
 	})
-	return recent
+	return size, known
 }
 
-func (dao *ImageDao) BucketToImage(UUID string, bucket *bolt.Bucket) *Image {
-	unlisted, err := strconv.ParseBool(string(bucket.Get(B(UUID + ":unlisted"))))
-	if err != nil {
-		unlisted = true // better safe than sorry
-	}
-	image := &Image{
-		UUID:      UUID,
-		path:      string(bucket.Get(B(UUID + ":path"))),
-		thumbPath: string(bucket.Get(B(UUID + ":thumbpath"))),
-		Added:     string(bucket.Get(B(UUID + ":added"))),
-		Unlisted:  unlisted,
-		Expires:   string(bucket.Get(B(UUID + ":expires"))),
-		Delete:    string(bucket.Get(B(UUID + ":delete"))),
-		cookie:    string(bucket.Get(B(UUID + ":cookie"))),
-		Owner:     string(bucket.Get(B(UUID + ":owner"))),
-		RecentKey: bucket.Get(B(UUID + ":recentkey")),
-	}
-
-	return image
+// removeDerivatives forgets all derivatives of blobKey and returns their
+// keys.
+func removeDerivatives(tx *bolt.Tx, blobKey string) []string {
+	var keys []string
+	prefix := B(blobKey + "/")
+	c := tx.Bucket(B(DERIVATIVE_BUCKET)).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		keys = append(keys, string(k[len(prefix):]))
+		c.Delete()
+	}
+	return keys
+}
+
+// ListRecent returns up to limit listed images, newest first, starting
+// before the recent sequence number before (0 for the newest). The second
+// return value is the cursor for the next page, 0 when there are no more.
+func (dao *ImageDao) ListRecent(before int, limit int) ([]string, int) {
+	var recent []string
+	var last, next int
+	dao.db.View(func(tx *bolt.Tx) error {
+		recentBucket := tx.Bucket(B(RECENT_BUCKET))
+		walkNewest(recentBucket, before, func(seq int, UUID string) bool {
+			if len(recent) == limit {
+				next = last
+				return false
+			}
+			recent = append(recent, UUID)
+			last = seq
+			return true
+		})
+		return nil
+	})
+	return recent, next
 }
 
 func B(s string) []byte {
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/unrolled/logger"
+)
+
+// newTestDao opens a migrated database in a temporary directory.
+func newTestDao(t *testing.T) *ImageDao {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "goimg.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	log := logger.New(logger.Options{Out: ioutil.Discard})
+	if err = Migrate(db, log); err != nil {
+		t.Fatal(err)
+	}
+	return NewImageDao(db, log)
+}
+
+func TestListRecentAcrossDeleted(t *testing.T) {
+	dao := newTestDao(t)
+	images := make(map[string]*Image)
+	for _, UUID := range []string{"1", "2", "3", "4", "5", "6"} {
+		image := NewImage("alice", UUID, UUID+".png", UUID+"_thumb.png", false, "", "key", "cookie")
+		if err := dao.Save(image); err != nil {
+			t.Fatal(err)
+		}
+		images[UUID] = image
+	}
+	deleteImage := func(UUID string) {
+		if _, err := dao.Delete(images[UUID]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteImage("2")
+
+	page, next := dao.ListRecent(0, 2)
+	if strings.Join(page, ",") != "6,5" || next == 0 {
+		t.Fatalf("first page = %v next %d, want 6,5", page, next)
+	}
+	// The image the cursor points at goes away between pages.
+	deleteImage("5")
+	page, next = dao.ListRecent(next, 2)
+	if strings.Join(page, ",") != "4,3" || next == 0 {
+		t.Fatalf("second page = %v next %d, want 4,3", page, next)
+	}
+	page, next = dao.ListRecent(next, 2)
+	if strings.Join(page, ",") != "1" || next != 0 {
+		t.Fatalf("last page = %v next %d, want 1 and no more", page, next)
+	}
+
+	owned, next := dao.ListByOwner("alice", 0, 2)
+	if strings.Join(uuids(owned), ",") != "6,4" {
+		t.Fatalf("first owner page = %v, want 6,4", uuids(owned))
+	}
+	deleteImage("4")
+	owned, next = dao.ListByOwner("alice", next, 2)
+	if strings.Join(uuids(owned), ",") != "3,1" {
+		t.Fatalf("second owner page = %v, want 3,1", uuids(owned))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp"
+)
+
+// A few hundred bytes can declare an image that takes gigabytes to decode,
+// so the dimensions an image declares in its header are checked against
+// the configured limits before it is decoded.
+
+// ImageLimitError is returned for images over the configured dimensions,
+// pixel count or number of animation frames.
+type ImageLimitError struct {
+	msg string
+}
+
+func (e *ImageLimitError) Error() string {
+	return e.msg
+}
+
+// checkConfig checks the dimensions from an image header.
+func checkConfig(conf image.Config, cfg Config) error {
+	switch {
+	case cfg.maxWidth > 0 && conf.Width > cfg.maxWidth:
+		return &ImageLimitError{fmt.Sprintf("Image is %d pixels wide, the limit is %d", conf.Width, cfg.maxWidth)}
+	case cfg.maxHeight > 0 && conf.Height > cfg.maxHeight:
+		return &ImageLimitError{fmt.Sprintf("Image is %d pixels high, the limit is %d", conf.Height, cfg.maxHeight)}
+	case cfg.maxPixels > 0 && int64(conf.Width)*int64(conf.Height) > int64(cfg.maxPixels)*1000*1000:
+		return &ImageLimitError{fmt.Sprintf("Image has %dx%d pixels, the limit is %d megapixels", conf.Width, conf.Height, cfg.maxPixels)}
+	}
+	return nil
+}
+
+// checkImage checks the image in the file at path against the limits
+// without decoding it, and returns its animation if it has one.
+func checkImage(path string, fileType string, cfg Config) (*animation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, _, err := image.DecodeConfig(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return nil, ErrDecode
+	}
+	if err = checkConfig(conf, cfg); err != nil {
+		return nil, err
+	}
+
+	anim, err := probeAnimation(path, fileType, cfg.maxFrames)
+	if err != nil {
+		return nil, err
+	}
+	if anim != nil && cfg.maxFrames > 0 && anim.frames > cfg.maxFrames {
+		return nil, &ImageLimitError{fmt.Sprintf("Animation has more than %d frames", cfg.maxFrames)}
+	}
+	return anim, nil
+}
+
+// decode decodes the image in r, upright, after checking its header
+// against the limits.
+func decode(r io.Reader, cfg Config) (image.Image, error) {
+	var header bytes.Buffer
+	conf, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, ErrDecode
+	}
+	if err = checkConfig(conf, cfg); err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(io.MultiReader(&header, r), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, ErrDecode
+	}
+	return img, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teris-io/shortid"
+	"github.com/unrolled/logger"
+)
+
+// An export is a tar archive meant for moving images to another instance.
+// It starts with a manifest holding one exportRecord per line, followed by
+// the originals under files/. Unlike a backup it doesn't depend on the
+// database layout, and importing adds to an existing instance.
+const (
+	EXPORT_VERSION  int    = 1
+	EXPORT_MANIFEST string = "goimg-export.jsonl"
+	EXPORT_FILES    string = "files/"
+
+	// What Import does with an image whose UUID is taken
+	COLLISION_SKIP   string = "skip"   // leave the existing image, skip this one
+	COLLISION_FAIL   string = "fail"   // stop the import
+	COLLISION_RENAME string = "rename" // import it under a new UUID
+)
+
+var ErrExportFormat = errors.New("not a goimg export")
+
+// exportRecord is the portable metadata of an image. Uploader cookies only
+// mean something to the instance that issued them and are left out.
+type exportRecord struct {
+	Version  int               `json:"v"`
+	UUID     string            `json:"uuid"`
+	File     string            `json:"file"` // archive entry holding the original
+	Added    string            `json:"added"`
+	Expires  string            `json:"expires,omitempty"`
+	Unlisted bool              `json:"unlisted"`
+	Owner    string            `json:"owner,omitempty"`
+	Token    string            `json:"token,omitempty"` // name of the API token it was uploaded with
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Delete   string            `json:"delete"`
+}
+
+// WriteExport streams every image and its original to w in upload order
+// and returns the number of images written. Images whose original is
+// missing from storage are left out.
+func WriteExport(w io.Writer, dao *ImageDao, storage Storage, logger *logger.Logger) (int, error) {
+	var images []*Image
+	err := dao.ForEach(func(image *Image) error {
+		images = append(images, image)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The manifest comes first so Import knows what each file is for as it
+	// streams past, which means checking the originals up front.
+	var manifest bytes.Buffer
+	var keys []string
+	infos := make(map[string]*StorageInfo)
+	enc := json.NewEncoder(&manifest)
+	count := 0
+	for _, image := range images {
+		key := path.Base(image.path)
+		if _, ok := infos[key]; !ok {
+			info, err := storage.Stat(key)
+			if os.IsNotExist(err) {
+				logger.Printf("Export skipping image with missing original [UUID:%s]\n", image.UUID)
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			infos[key] = info
+			keys = append(keys, key)
+		}
+		err = enc.Encode(&exportRecord{
+			Version:  EXPORT_VERSION,
+			UUID:     image.UUID,
+			File:     EXPORT_FILES + key,
+			Added:    image.Added,
+			Expires:  image.Expires,
+			Unlisted: image.Unlisted,
+			Owner:    image.Owner,
+			Token:    image.Token,
+			Metadata: image.Metadata,
+			Delete:   image.Delete,
+		})
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	tw := tar.NewWriter(w)
+	if err = writeTarFile(tw, EXPORT_MANIFEST, int64(manifest.Len()), time.Now().UTC(), &manifest); err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		r, err := storage.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		err = writeTarFile(tw, EXPORT_FILES+key, infos[key].Size, infos[key].ModTime, r)
+		r.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, tw.Close()
+}
+
+// ImportReport summarizes an Import.
+type ImportReport struct {
+	Imported int
+	Skipped  []string          // UUIDs already taken, with COLLISION_SKIP
+	Renamed  map[string]string // old UUID to new, with COLLISION_RENAME
+	Missing  []string          // UUIDs whose original wasn't in the archive
+}
+
+// Import reads an export, optionally gzipped, and adds its images through
+// ImageDao.Save, keeping their UUIDs and delete keys. Each original is
+// staged like an upload, so thumbnails are rendered and identical files
+// stored once. collision says what to do when a UUID is already taken.
+func Import(r io.Reader, dao *ImageDao, fs *FS, collision string, logger *logger.Logger) (*ImportReport, error) {
+	switch collision {
+	case COLLISION_SKIP, COLLISION_FAIL, COLLISION_RENAME:
+	default:
+		return nil, fmt.Errorf("unknown collision mode: %s", collision)
+	}
+
+	r, err := gunzip(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != EXPORT_MANIFEST {
+		return nil, ErrExportFormat
+	}
+	byFile := make(map[string][]*exportRecord)
+	var order []*exportRecord
+	dec := json.NewDecoder(tr)
+	for {
+		record := &exportRecord{}
+		if err = dec.Decode(record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrExportFormat, err)
+		}
+		if record.Version != EXPORT_VERSION {
+			return nil, fmt.Errorf("unsupported export version %d", record.Version)
+		}
+		if record.UUID == "" || record.File == "" {
+			return nil, fmt.Errorf("%s: record without uuid or file", ErrExportFormat)
+		}
+		byFile[record.File] = append(byFile[record.File], record)
+		order = append(order, record)
+	}
+
+	report := &ImportReport{Renamed: make(map[string]string)}
+	imported := make(map[*exportRecord]bool)
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		records := byFile[hdr.Name]
+		if len(records) == 0 || hdr.Typeflag != tar.TypeReg {
+			logger.Printf("Import ignoring unexpected entry: %s\n", hdr.Name)
+			continue
+		}
+		if err = importFile(tr, records, dao, fs, collision, report); err != nil {
+			return report, fmt.Errorf("importing %s: %s", hdr.Name, err)
+		}
+		for _, record := range records {
+			imported[record] = true
+		}
+	}
+
+	for _, record := range order {
+		if !imported[record] {
+			report.Missing = append(report.Missing, record.UUID)
+		}
+	}
+	return report, nil
+}
+
+// importFile stages one original and saves every image sharing it, then
+// commits the file. If the file can't be stored the new records are
+// removed again, as an upload would.
+func importFile(r io.Reader, records []*exportRecord, dao *ImageDao, fs *FS, collision string, report *ImportReport) error {
+	upload, err := fs.Stage(r)
+	if err != nil {
+		return err
+	}
+	defer upload.Cleanup()
+
+	var saved []*Image
+	for _, record := range records {
+		image := &Image{
+			UUID:      record.UUID,
+			path:      upload.Key,
+			thumbPath: upload.ThumbKey,
+			Added:     record.Added,
+			Unlisted:  record.Unlisted,
+			Expires:   record.Expires,
+			Delete:    record.Delete,
+			Owner:     record.Owner,
+			Token:     record.Token,
+			Metadata:  record.Metadata,
+			Frames:    upload.Frames,
+			Duration:  upload.Duration,
+			Hash:      upload.Hash,
+		}
+		err = dao.Save(image)
+		for err == ErrImageExists && collision == COLLISION_RENAME {
+			image.UUID, _ = shortid.Generate()
+			err = dao.Save(image)
+		}
+		if err == ErrImageExists && collision == COLLISION_SKIP {
+			report.Skipped = append(report.Skipped, record.UUID)
+			continue
+		} else if err == ErrImageExists {
+			err = fmt.Errorf("image %s already exists", record.UUID)
+		}
+		if err != nil {
+			rollbackImport(dao, saved)
+			return err
+		}
+		if image.UUID != record.UUID {
+			report.Renamed[record.UUID] = image.UUID
+		}
+		saved = append(saved, image)
+	}
+
+	if len(saved) == 0 {
+		return nil
+	}
+	if err = upload.Commit(); err != nil {
+		rollbackImport(dao, saved)
+		return err
+	}
+	report.Imported += len(saved)
+	return nil
+}
+
+func rollbackImport(dao *ImageDao, images []*Image) {
+	for _, image := range images {
+		if _, err := dao.Delete(image); err != nil {
+			dao.logger.Println("Error rolling back imported image:", err)
+		}
+	}
+}
+
+// String lists what happened to images that weren't imported as is.
+func (report *ImportReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Imported %d images\n", report.Imported)
+	renamed := make([]string, 0, len(report.Renamed))
+	for old := range report.Renamed {
+		renamed = append(renamed, old)
+	}
+	sort.Strings(renamed)
+	for _, old := range renamed {
+		fmt.Fprintf(&b, "Renamed %s to %s\n", old, report.Renamed[old])
+	}
+	for _, UUID := range report.Skipped {
+		fmt.Fprintf(&b, "Skipped %s, UUID already taken\n", UUID)
+	}
+	for _, UUID := range report.Missing {
+		fmt.Fprintf(&b, "Missing original of %s\n", UUID)
+	}
+	return b.String()
+}
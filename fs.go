@@ -2,128 +2,421 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"path/filepath"
+	"path"
+	"sync"
 
+	"github.com/HugoSmits86/nativewebp"
 	"github.com/corona10/goimghdr"
 	"github.com/disintegration/imaging"
 	"github.com/unrolled/logger"
 )
 
+const (
+	THUMB_SIZE int = 500
+)
+
 type FS struct {
-	cfg    Config
-	logger *logger.Logger
+	cfg     Config
+	storage Storage
+	cache   *Cache
+	flight  flightGroup
+	logger  *logger.Logger
+
+	mu     sync.Mutex     // held while deleting stored files
+	claims map[string]int // stored originals that uploads are about to reference
 }
 
-func NewFS(cfg Config, logger *logger.Logger) *FS {
+func NewFS(cfg Config, storage Storage, logger *logger.Logger) *FS {
 	return &FS{
-		cfg:    cfg,
-		logger: logger,
+		cfg:     cfg,
+		storage: storage,
+		cache:   NewCache(int64(cfg.cacheSize) * 1024 * 1024),
+		logger:  logger,
+		claims:  make(map[string]int),
 	}
 }
 
-// Save saves a file to disk using the provided id as a name.
-// Returns two strings: the image path and the thumbnail path.
-// Returns two empty strings upon failure.
-func (fs *FS) Save(file io.Reader, id string) (string, string) {
-	// read in file bytes for later
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return "", ""
+var (
+	ErrUnsupportedType = errors.New("file is not a supported image")
+	ErrDecode          = errors.New("image could not be decoded")
+)
+
+// Upload is a file staged in the data directory together with its
+// thumbnail, waiting to be committed to storage. Nothing is visible in
+// storage until Commit succeeds.
+type Upload struct {
+	Key      string
+	ThumbKey string
+	Type     string // detected file type, e.g. "png"
+	Size     int64
+	Metadata map[string]string // display copy of the stripped metadata, if kept
+	Frames   int               // animation frames, 0 for still images
+	Duration int               // milliseconds of one loop of an animation
+	Hash     string            // perceptual hash of the thumbnail, empty if it failed
+
+	fs       *FS
+	tmpPath  string // staged original, empty if already stored
+	thumbTmp string // staged thumbnail, empty if already stored
+
+	thumbSize int64
+	claimed   bool // holding a claim on the stored original
+}
+
+// Stage streams a file into a temporary file in the data directory and
+// renders its thumbnail next to it. The storage key is the SHA-256 digest
+// of the contents, so identical uploads share one stored file. Only the
+// header bytes are kept in memory for type detection. Images over the
+// configured dimensions are rejected before anything decodes them, and
+// when configured metadata is stripped before hashing.
+// Callers must call Cleanup once done with the Upload.
+func (fs *FS) Stage(file io.Reader) (*Upload, error) {
+	// sniff the header for the file type
+	header := make([]byte, 32)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
 	}
+	header = header[:n]
 
 	// validate file type
-	fileType, err := goimghdr.WhatFromReader(bytes.NewReader(fileBytes))
+	fileType, err := goimghdr.WhatFromReader(bytes.NewReader(header))
 	if fileType == "" || err != nil {
-		fs.logger.Println(err)
-		return "", ""
+		return nil, ErrUnsupportedType
 	}
 
-	// create file on disk
-	newPath := filepath.Join(cfg.data, id+"."+fileType)
-	newFile, err := os.Create(newPath)
+	// stream the rest of the upload to a temporary file, hashing as we go
+	tmp, err := ioutil.TempFile(fs.cfg.data, ".upload-")
 	if err != nil {
-		fs.logger.Println(err)
-		return "", ""
+		return nil, err
 	}
-	defer newFile.Close()
-
-	// write file to disk
-	if _, err = newFile.Write(fileBytes); err != nil {
-		fs.logger.Println(err)
-		return "", ""
+	upload := &Upload{fs: fs, tmpPath: tmp.Name(), Type: fileType}
+	hash := sha256.New()
+	upload.Size, err = io.Copy(io.MultiWriter(tmp, hash), io.MultiReader(bytes.NewReader(header), file))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
 	}
-
-	// create thumbnail file on disk
-	thumbPath := filepath.Join(cfg.data, id+"_thumb."+fileType)
-	fs.logger.Printf("New image upload: %s %s\n", newPath, thumbPath)
-	thumbFile, err := os.Create(thumbPath)
 	if err != nil {
-		fs.logger.Println(err)
-		// TODO Clean up original image if thumbnail cannot be generated.
-		return "", ""
+		upload.Cleanup()
+		return nil, err
 	}
-	defer thumbFile.Close()
 
-	// create image reader
-	reader := bytes.NewReader(fileBytes)
-	imageObj, err := imaging.Decode(reader)
+	anim, err := checkImage(upload.tmpPath, fileType, fs.cfg)
 	if err != nil {
-		fs.logger.Println("Error decoding: ", err)
-		// TODO Clean up thumbnail and original upon failure.
-		return "", ""
+		upload.Cleanup()
+		return nil, err
+	}
+	if anim != nil && anim.frames > 1 {
+		upload.Frames, upload.Duration = anim.frames, anim.duration
 	}
 
-	// Make thumbnail
-	thumbnailImage := imaging.Fit(imageObj, 500, 500, imaging.Lanczos)
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if fs.cfg.stripMetadata && canStripMetadata(fileType) {
+		if digest, err = upload.sanitize(); err != nil {
+			upload.Cleanup()
+			return nil, err
+		}
+	}
+	upload.Key = digest + "." + fileType
+	upload.ThumbKey = digest + "_thumb." + fileType
 
-	// Save to disk
-	err = imaging.Save(thumbnailImage, thumbPath)
-	if err != nil {
-		fs.logger.Println("Error saving: ", err)
-		// TODO Clean up thumbnail and original upon failure.
-		return "", ""
+	// Another image may be deleting the stored original while this upload
+	// finds it, the claim keeps it until this one has added its reference.
+	fs.claim(upload.Key)
+	upload.claimed = true
+	orig, thumb := fs.exists(upload.Key), fs.exists(upload.ThumbKey)
+	if orig && thumb {
+		fs.logger.Printf("Duplicate image upload: %s\n", upload.Key)
+		os.Remove(upload.tmpPath)
+		upload.tmpPath = ""
+		upload.hashThumbnail()
+		return upload, nil
+	}
+
+	if !thumb {
+		if err = upload.stageThumbnail(); err != nil {
+			upload.Cleanup()
+			return nil, err
+		}
+	}
+	if orig {
+		os.Remove(upload.tmpPath)
+		upload.tmpPath = ""
 	}
+	upload.hashThumbnail()
 
-	return newPath, thumbPath
+	return upload, nil
 }
 
-func (fs *FS) Delete(image *Image) error {
-	err := os.Remove(image.path)
+// stageThumbnail decodes the staged original and writes its thumbnail to
+// another temporary file.
+func (u *Upload) stageThumbnail() error {
+	if !encodable(u.ThumbKey) {
+		return ErrUnsupportedType
+	}
+	reader, err := os.Open(u.tmpPath)
 	if err != nil {
 		return err
 	}
-	fs.logger.Println("Deleted image: ", image.UUID)
-
-	err = fs.DeleteThumbnail(image)
+	defer reader.Close()
+	thumbFile, err := ioutil.TempFile(u.fs.cfg.data, ".thumb-")
 	if err != nil {
 		return err
 	}
+	u.thumbTmp = thumbFile.Name()
+	err = writeThumbnail(thumbFile, reader, u.ThumbKey, u.fs.cfg)
+	if err != nil {
+		u.fs.logger.Println("Error decoding: ", err)
+	} else {
+		var finfo os.FileInfo
+		if finfo, err = thumbFile.Stat(); err == nil {
+			u.thumbSize = finfo.Size()
+		}
+	}
+	if cerr := thumbFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
+// Commit moves the staged files into storage. If any move fails, files
+// already moved by this call are removed again so storage is left as it
+// was.
+func (u *Upload) Commit() error {
+	var stored []string
+	for _, staged := range []struct{ path, key string }{
+		{u.thumbTmp, u.ThumbKey},
+		{u.tmpPath, u.Key},
+	} {
+		if staged.path == "" {
+			continue
+		}
+		if err := u.fs.putFile(staged.key, staged.path); err != nil {
+			for _, key := range stored {
+				u.fs.storage.Delete(key)
+			}
+			return err
+		}
+		stored = append(stored, staged.key)
+	}
+	if u.thumbTmp != "" {
+		u.fs.cache.Add(u.ThumbKey, u.thumbSize)
+	}
+	u.fs.logger.Printf("New image upload: %s %s\n", u.Key, u.ThumbKey)
 	return nil
 }
 
-func (fs *FS) DeleteThumbnail(image *Image) error {
-	err := os.Remove(image.thumbPath)
+// Cleanup removes any staged files that were not committed and releases
+// the claim on the stored original.
+func (u *Upload) Cleanup() {
+	for _, path := range []string{u.tmpPath, u.thumbTmp} {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+	if u.claimed {
+		u.fs.release(u.Key)
+		u.claimed = false
+	}
+}
+
+// claim keeps the stored file key from being deleted until release.
+func (fs *FS) claim(key string) {
+	fs.mu.Lock()
+	fs.claims[key]++
+	fs.mu.Unlock()
+}
+
+func (fs *FS) release(key string) {
+	fs.mu.Lock()
+	if fs.claims[key]--; fs.claims[key] <= 0 {
+		delete(fs.claims, key)
+	}
+	fs.mu.Unlock()
+}
+
+// putFile moves the local file at path into storage under key, renaming it
+// in place when the backend allows.
+func (fs *FS) putFile(key string, path string) error {
+	if mover, ok := fs.storage.(Mover); ok {
+		return mover.Move(path, key)
+	}
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	fs.logger.Println("Deleted thumbnail: ", image.UUID)
-	return nil
+	defer file.Close()
+	return fs.storage.Put(key, file)
+}
+
+func (fs *FS) exists(key string) bool {
+	_, err := fs.storage.Stat(key)
+	return err == nil
+}
+
+// Delete removes the given keys from storage, as returned by
+// ImageDao.DeleteWithTx. Keys that are already gone are skipped.
+func (fs *FS) Delete(keys []string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var firstErr error
+	for _, key := range keys {
+		if fs.claims[key] > 0 {
+			fs.logger.Println("Kept file, an upload is referencing it again: ", key)
+			continue
+		}
+		err := fs.storage.Delete(key)
+		if err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		fs.logger.Println("Deleted file: ", key)
+	}
+	return firstErr
+}
+
+// Render returns the storage key of variant v of img, generating it from
+// the original and storing it first if it is not cached yet. The boolean
+// is true when the variant was generated.
+func (fs *FS) Render(img *Image, v *Variant) (string, bool, error) {
+	key := v.Key(img.path)
+	if fs.exists(key) {
+		return key, false, nil
+	}
+
+	var opts []imaging.EncodeOption
+	if v.Quality != 0 {
+		opts = append(opts, imaging.JPEGQuality(v.Quality))
+	}
+	err := fs.render(img.path, key, func(imageObj image.Image) image.Image {
+		switch v.Mode {
+		case MODE_FILL:
+			return imaging.Fill(imageObj, v.Width, v.Height, imaging.Center, imaging.Lanczos)
+		case MODE_CROP:
+			return imaging.CropCenter(imageObj, v.Width, v.Height)
+		}
+		// A zero dimension leaves that side unconstrained.
+		width, height := v.Width, v.Height
+		if width == 0 {
+			width = imageObj.Bounds().Dx()
+		}
+		if height == 0 {
+			height = imageObj.Bounds().Dy()
+		}
+		return imaging.Fit(imageObj, width, height, imaging.Lanczos)
+	}, opts...)
+	if err != nil {
+		return "", false, err
+	}
+	return key, true, nil
+}
+
+// Thumbnail regenerates the thumbnail of image from its original, e.g.
+// after the cache evicted it.
+func (fs *FS) Thumbnail(image *Image) error {
+	if fs.exists(image.thumbPath) {
+		return nil
+	}
+	if !encodable(image.thumbPath) {
+		return ErrUnsupportedType
+	}
+	return fs.derive(image.path, image.thumbPath, func(w io.Writer, src io.Reader) error {
+		return writeThumbnail(w, src, image.thumbPath, fs.cfg)
+	})
+}
+
+// render decodes srcKey, transforms it and stores the result under key in
+// the format matching key's extension.
+func (fs *FS) render(srcKey string, key string, transform func(image.Image) image.Image, opts ...imaging.EncodeOption) error {
+	if !encodable(key) {
+		return ErrUnsupportedType
+	}
+	return fs.derive(srcKey, key, func(w io.Writer, src io.Reader) error {
+		imageObj, err := decode(src, fs.cfg)
+		if err != nil {
+			fs.logger.Println("Error decoding: ", err)
+			return err
+		}
+		return encode(w, transform(imageObj), key, opts...)
+	})
+}
+
+// encodable reports whether images can be stored in the format matching
+// key's extension.
+func encodable(key string) bool {
+	if path.Ext(key) == ".webp" {
+		return true
+	}
+	_, err := imaging.FormatFromFilename(key)
+	return err == nil
+}
+
+// encode writes img to w in the format matching key's extension. imaging
+// can't write WebP, so that is encoded, losslessly, by nativewebp.
+func encode(w io.Writer, img image.Image, key string, opts ...imaging.EncodeOption) error {
+	if path.Ext(key) == ".webp" {
+		return nativewebp.Encode(w, img, nil)
+	}
+	format, err := imaging.FormatFromFilename(key)
+	if err != nil {
+		return err
+	}
+	return imaging.Encode(w, img, format, opts...)
+}
+
+// derive stores what write makes of srcKey under key. Concurrent calls for
+// the same key share a single rendering.
+func (fs *FS) derive(srcKey string, key string, write func(w io.Writer, src io.Reader) error) error {
+	return fs.flight.Do(key, func() error {
+		src, err := fs.storage.Get(srcKey)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = write(&buf, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+		size := int64(buf.Len())
+		if err = fs.storage.Put(key, &buf); err != nil {
+			return err
+		}
+		fs.cache.Add(key, size)
+		fs.logger.Printf("Rendered: %s\n", key)
+		return nil
+	})
+}
+
+// thumbnail scales img down to fit the thumbnail size.
+func thumbnail(img image.Image) image.Image {
+	return imaging.Fit(img, THUMB_SIZE, THUMB_SIZE, imaging.Lanczos)
 }
 
 // Ensure returns two booleans. First is true if original image is
-// present on disk. Second boolean is true if thumbnail is present
-// on disk.
+// present in storage. Second boolean is true if thumbnail is present
+// in storage.
 func (fs *FS) Ensure(image *Image) (bool, bool) {
 	orig, thumb := true, true
-	if _, err := os.Stat(image.path); os.IsNotExist(err) {
+	if _, err := fs.storage.Stat(image.path); err != nil {
 		orig = false
 	}
-	if _, err := os.Stat(image.thumbPath); os.IsNotExist(err) {
+	if _, err := fs.storage.Stat(image.thumbPath); err != nil {
 		thumb = false
 	}
 	return orig, thumb
 }
+
+// Stream writes the object stored under key to w.
+func (fs *FS) Stream(w http.ResponseWriter, r *http.Request, key string) error {
+	return fs.storage.Stream(w, r, key)
+}
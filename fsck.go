@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/unrolled/logger"
+)
+
+// Kinds of problems found by Fsck.
+const (
+	FSCK_ORPHAN_FILE          string = "orphan file"
+	FSCK_STALE_TEMP           string = "stale temporary file"
+	FSCK_MISSING_ORIGINAL     string = "missing original"
+	FSCK_MISSING_THUMBNAIL    string = "missing thumbnail"
+	FSCK_DANGLING_RECENT      string = "dangling recent entry"
+	FSCK_DANGLING_EXPIRATION  string = "dangling expiration entry"
+	FSCK_MISSING_EXPIRATION   string = "missing expiration entry"
+	FSCK_RECENT_KEY_MISMATCH  string = "recentkey mismatch"
+	FSCK_DANGLING_DERIVATIVES string = "dangling derivative entry"
+
+	// Files and images younger than this may belong to an upload or
+	// rendering in progress, so they are never reported.
+	FSCK_GRACE = time.Hour
+)
+
+// FsckIssue is a single inconsistency between the database and storage.
+type FsckIssue struct {
+	Kind     string
+	Key      string // UUID, storage key or bucket key
+	Detail   string
+	Repaired bool
+}
+
+// Fsck reconciles the database with the files in storage.
+type Fsck struct {
+	db     *bolt.DB
+	dao    *ImageDao
+	fs     *FS
+	stop   chan bool
+	logger *logger.Logger
+}
+
+func NewFsck(db *bolt.DB, dao *ImageDao, fs *FS, logger *logger.Logger) *Fsck {
+	return &Fsck{
+		db:     db,
+		dao:    dao,
+		fs:     fs,
+		stop:   make(chan bool),
+		logger: logger,
+	}
+}
+
+// Start runs a check every interval until Stop is called, logging what it
+// finds and repairing it if asked to.
+func (f *Fsck) Start(interval time.Duration, repair bool) {
+	f.logger.Println("Fsck Started")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			issues, err := f.Run(repair)
+			if err != nil {
+				f.logger.Printf("Error running fsck: %s\n", err)
+				continue
+			}
+			for _, issue := range issues {
+				f.logger.Printf("Fsck %s\n", issue)
+			}
+		case <-f.stop:
+			f.logger.Println("Fsck Shut down")
+			return
+		}
+	}
+}
+
+func (f *Fsck) Stop() {
+	f.stop <- true
+}
+
+func (issue FsckIssue) String() string {
+	s := issue.Kind + ": " + issue.Key
+	if issue.Detail != "" {
+		s += " (" + issue.Detail + ")"
+	}
+	if issue.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// Run checks the database against storage and returns what is wrong. With
+// repair, database entries are fixed in one transaction and files are
+// deleted once it commits.
+func (f *Fsck) Run(repair bool) ([]FsckIssue, error) {
+	// Snapshot storage before the database, so files committed in between
+	// are already referenced when the database is read. Uploads save their
+	// record before committing files, so new images are skipped below.
+	stored := make(map[string]*StorageInfo)
+	err := f.fs.storage.List(func(key string, info *StorageInfo) error {
+		stored[key] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fsckRun{Fsck: f, repair: repair, stored: stored}
+	if repair {
+		err = f.db.Update(c.check)
+	} else {
+		err = f.db.View(c.check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.checkTemp()
+
+	if repair {
+		if err = f.fs.Delete(c.deletes); err != nil {
+			f.logger.Printf("Error deleting files for fsck: %s\n", err)
+		}
+	}
+	return c.issues, nil
+}
+
+// fsckRun holds the state of a single Fsck.Run.
+type fsckRun struct {
+	*Fsck
+	repair bool
+	stored map[string]*StorageInfo
+	issues []FsckIssue
+
+	// Deferred until the transaction commits
+	deletes []string
+}
+
+func (c *fsckRun) report(kind string, key string, detail string) {
+	c.issues = append(c.issues, FsckIssue{Kind: kind, Key: key, Detail: detail, Repaired: c.repair})
+}
+
+func (c *fsckRun) check(tx *bolt.Tx) error {
+	imageBucket := tx.Bucket(B(IMAGE_BUCKET))
+	images := make(map[string]*Image)
+	var ordered []*Image
+	err := imageBucket.ForEach(func(k, v []byte) error {
+		image, err := getImage(imageBucket, string(k))
+		if err != nil {
+			return err
+		}
+		images[image.UUID] = image
+		ordered = append(ordered, image)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Seq < ordered[j].Seq
+	})
+
+	if err = c.checkRecent(tx, images, ordered); err != nil {
+		return err
+	}
+	c.checkExpiration(tx, images, ordered)
+
+	// Files must be checked last, as repairs above may delete records.
+	referenced := make(map[string]bool)
+	cached := tx.Bucket(B(CACHE_BUCKET))
+	for _, image := range ordered {
+		if uploading(image) {
+			// Records are saved before their files are committed.
+			referenced[path.Base(image.path)] = true
+			referenced[path.Base(image.thumbPath)] = true
+			continue
+		}
+		if _, ok := c.stored[path.Base(image.path)]; !ok {
+			c.report(FSCK_MISSING_ORIGINAL, image.UUID, image.path)
+			if c.repair {
+				orphans, err := c.dao.DeleteWithTx(image, tx)
+				if err != nil {
+					return err
+				}
+				if image.Expires != "" {
+					removeExpiration(tx, image.Expires, image.UUID)
+				}
+				c.deletes = append(c.deletes, orphans...)
+			}
+			continue
+		}
+		referenced[path.Base(image.path)] = true
+		referenced[path.Base(image.thumbPath)] = true
+		// Thumbnails evicted from the cache are expected to be missing and
+		// are rendered again on request, only one the cache still counts is
+		// a problem. Repairing drops its entry so it no longer uses the budget.
+		if _, ok := c.stored[path.Base(image.thumbPath)]; !ok && cached.Get(B(image.thumbPath)) != nil {
+			c.report(FSCK_MISSING_THUMBNAIL, image.UUID, image.thumbPath)
+			if c.repair {
+				cached.Delete(B(image.thumbPath))
+			}
+		}
+	}
+	c.checkDerivatives(tx, referenced)
+
+	for _, key := range c.sortedStored() {
+		if referenced[key] || c.isDatabase(key) || path.Ext(key) == "" {
+			continue
+		}
+		info := c.stored[key]
+		if time.Since(info.ModTime) < FSCK_GRACE {
+			continue
+		}
+		if !c.ownsStorage() {
+			// Other instances' files and unrelated objects may share the bucket.
+			c.issues = append(c.issues, FsckIssue{Kind: FSCK_ORPHAN_FILE, Key: key, Detail: fmt.Sprintf("%d bytes, shared bucket, set --s3prefix to remove", info.Size)})
+			continue
+		}
+		c.report(FSCK_ORPHAN_FILE, key, fmt.Sprintf("%d bytes", info.Size))
+		c.deletes = append(c.deletes, key)
+	}
+	if c.repair {
+		forgetCached(tx, c.deletes)
+	}
+	return nil
+}
+
+// uploading reports whether image was added less than FSCK_GRACE ago, so
+// its files may still be on their way into storage.
+func uploading(image *Image) bool {
+	added, err := time.Parse(time.RFC3339, image.Added)
+	return err == nil && time.Since(added) < FSCK_GRACE
+}
+
+// checkRecent finds recent entries for missing, unlisted or already listed
+// images, and listed images whose recentkey points at another image's
+// entry. Entries trimmed by GC are expected and not reported.
+func (c *fsckRun) checkRecent(tx *bolt.Tx, images map[string]*Image, ordered []*Image) error {
+	recent := tx.Bucket(B(RECENT_BUCKET))
+	entries := make(map[string][][]byte)
+	var stray [][]byte
+	recent.ForEach(func(k, v []byte) error {
+		k = append([]byte{}, k...)
+		if images[string(v)] == nil {
+			c.report(FSCK_DANGLING_RECENT, fmt.Sprint(btoi(k)), "no image "+string(v))
+			stray = append(stray, k)
+		} else {
+			entries[string(v)] = append(entries[string(v)], k)
+		}
+		return nil
+	})
+
+	for _, image := range ordered {
+		own := image.RecentKey != nil && string(recent.Get(image.RecentKey)) == image.UUID
+		var want []byte
+		if !image.Unlisted {
+			if own {
+				want = image.RecentKey
+			} else if keys := entries[image.UUID]; len(keys) > 0 {
+				want = keys[len(keys)-1]
+			}
+		}
+		for _, k := range entries[image.UUID] {
+			if !bytes.Equal(k, want) {
+				c.report(FSCK_DANGLING_RECENT, fmt.Sprint(btoi(k)), "extra entry for "+image.UUID)
+				stray = append(stray, k)
+			}
+		}
+		if !bytes.Equal(want, image.RecentKey) && (want != nil || own || recent.Get(image.RecentKey) != nil) {
+			c.report(FSCK_RECENT_KEY_MISMATCH, image.UUID, "")
+			if c.repair {
+				image.RecentKey = want
+				if err := putImage(tx.Bucket(B(IMAGE_BUCKET)), image); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if c.repair {
+		for _, k := range stray {
+			if err := recent.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkExpiration finds expiration entries that don't match an image, and
+// expiring images GC would never find.
+func (c *fsckRun) checkExpiration(tx *bolt.Tx, images map[string]*Image, ordered []*Image) {
+	type entry struct{ expires, UUID string }
+	var dangling []entry
+	found := make(map[string]bool)
+	tx.Bucket(B(EXPIRATION_BUCKET)).ForEach(func(k, v []byte) error {
+		for _, UUID := range strings.Split(string(v), ",") {
+			if image := images[UUID]; image != nil && image.Expires == string(k) {
+				found[UUID] = true
+				continue
+			}
+			c.report(FSCK_DANGLING_EXPIRATION, string(k), UUID)
+			dangling = append(dangling, entry{string(k), UUID})
+		}
+		return nil
+	})
+
+	for _, image := range ordered {
+		if image.Expires != "" && !found[image.UUID] {
+			c.report(FSCK_MISSING_EXPIRATION, image.UUID, image.Expires)
+			if c.repair {
+				addExpiration(tx, image.Expires, image.UUID)
+			}
+		}
+	}
+	if c.repair {
+		for _, e := range dangling {
+			removeExpiration(tx, e.expires, e.UUID)
+		}
+	}
+}
+
+// checkDerivatives marks derivatives of referenced files as referenced, and
+// drops the entries of derivatives whose original is gone. Their files are
+// then reported as orphans.
+func (c *fsckRun) checkDerivatives(tx *bolt.Tx, referenced map[string]bool) {
+	var dangling []string
+	tx.Bucket(B(DERIVATIVE_BUCKET)).ForEach(func(k, v []byte) error {
+		i := bytes.LastIndexByte(k, '/')
+		if i < 0 {
+			return nil
+		}
+		if referenced[path.Base(string(k[:i]))] {
+			referenced[string(k[i+1:])] = true
+		} else {
+			c.report(FSCK_DANGLING_DERIVATIVES, string(k), "")
+			dangling = append(dangling, string(k))
+		}
+		return nil
+	})
+	if c.repair {
+		bucket := tx.Bucket(B(DERIVATIVE_BUCKET))
+		for _, k := range dangling {
+			bucket.Delete(B(k))
+		}
+	}
+}
+
+// checkTemp finds temporary files left in the data directory by uploads
+// and writes that never finished.
+func (c *fsckRun) checkTemp() {
+	files, err := ioutil.ReadDir(c.fs.cfg.data)
+	if err != nil {
+		c.logger.Printf("Error reading data directory for fsck: %s\n", err)
+		return
+	}
+	for _, finfo := range files {
+		name := finfo.Name()
+		if finfo.IsDir() || time.Since(finfo.ModTime()) < FSCK_GRACE {
+			continue
+		}
+		if !strings.HasPrefix(name, ".upload-") && !strings.HasPrefix(name, ".thumb-") && !strings.HasPrefix(name, ".put-") && !strings.HasPrefix(name, ".ready-") {
+			continue
+		}
+		c.report(FSCK_STALE_TEMP, name, fmt.Sprintf("%d bytes", finfo.Size()))
+		if c.repair {
+			os.Remove(filepath.Join(c.fs.cfg.data, name))
+		}
+	}
+}
+
+// isDatabase reports whether key is the database file itself, which may
+// live in the data directory.
+func (c *fsckRun) isDatabase(key string) bool {
+	if c.fs.cfg.storage != "" && c.fs.cfg.storage != STORAGE_DISK {
+		return false
+	}
+	db, err1 := filepath.Abs(c.db.Path())
+	file, err2 := filepath.Abs(filepath.Join(c.fs.cfg.data, key))
+	return err1 == nil && err2 == nil && db == file
+}
+
+// ownsStorage reports whether every file in storage belongs to this
+// instance, so orphans can be deleted. That holds for the data directory
+// and for a bucket under this instance's own key prefix.
+func (c *fsckRun) ownsStorage() bool {
+	return c.fs.cfg.storage == "" || c.fs.cfg.storage == STORAGE_DISK || c.fs.cfg.s3Prefix != ""
+}
+
+func (c *fsckRun) sortedStored() []string {
+	keys := make([]string, 0, len(c.stored))
+	for key := range c.stored {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
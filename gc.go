@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -16,9 +18,13 @@ const (
 
 var (
 	cmd = make(chan int)
+
+	errDryRun = errors.New("dry run")
 )
 
 type GC struct {
+	ticked int64 // UnixNano of the last tick, first for atomic alignment
+
 	db     *bolt.DB
 	dao    *ImageDao
 	fs     *FS
@@ -37,21 +43,31 @@ func NewGC(db *bolt.DB, dao *ImageDao, fs *FS, wg *sync.WaitGroup, logger *logge
 	}
 }
 
+// Start runs GC every interval until Stop is called. The caller adds to the
+// WaitGroup before starting it, and Stop waits for a running collection to
+// finish.
 func (gc *GC) Start() {
 	//https://golang.org/pkg/time/#Ticker
-	gc.wg.Add(1)
+	defer gc.wg.Done()
 	gc.logger.Println("GC Started")
+	gc.tick()
 	ticker := time.NewTicker(time.Duration(cfg.gcInterval) * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
+			gc.tick()
 			gc.do()
 			break
 		case msg := <-cmd:
 			if msg == RUN {
 				gc.do()
 			} else if msg == STOP {
-				gc.wg.Done()
+				// Keep the cache accesses seen since the last run.
+				gc.db.Update(func(tx *bolt.Tx) error {
+					gc.fs.cache.Flush(tx, gc.fs.storage)
+					return nil
+				})
 				gc.logger.Println("GC Shut down")
 				return
 			}
@@ -60,43 +76,122 @@ func (gc *GC) Start() {
 	}
 }
 
+func (gc *GC) tick() {
+	atomic.StoreInt64(&gc.ticked, time.Now().UnixNano())
+}
+
+// LastTick returns when the GC loop last woke up on its timer.
+func (gc *GC) LastTick() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&gc.ticked))
+}
+
 func (gc *GC) do() {
-	gc.db.Update(func(tx *bolt.Tx) error {
-		gc.doGCRecent(tx)
-		gc.doGCExpired(tx)
+	if _, err := gc.Run(false); err != nil {
+		gc.logger.Printf("Error running GC: %s\n", err)
+	}
+}
+
+// GCReport summarizes one garbage collection run.
+type GCReport struct {
+	Trimmed int      // entries dropped from the recent listing
+	Expired []string // UUIDs of expired images removed
+	Evicted int      // cached files evicted
+	Deleted []string // storage keys removed
+}
+
+// Run collects garbage once. Files are only deleted after the transaction
+// commits. With dryRun the transaction is rolled back and nothing is
+// deleted, but the report still lists what would have been.
+func (gc *GC) Run(dryRun bool) (*GCReport, error) {
+	start := time.Now()
+	report := &GCReport{}
+	err := gc.db.Update(func(tx *bolt.Tx) error {
+		report.Trimmed = gc.doGCRecent(tx)
+		gc.doGCQuotas(tx)
+		report.Expired, report.Deleted = gc.doGCExpired(tx)
+		evicted := gc.doGCCache(tx, dryRun)
+		report.Evicted = len(evicted)
+		report.Deleted = append(report.Deleted, evicted...)
+		if dryRun {
+			return errDryRun
+		}
 		return nil
 	})
+	if err == errDryRun {
+		return report, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = gc.fs.Delete(report.Deleted); err != nil {
+		gc.logger.Printf("Error deleting files for GC: %s\n", err)
+	}
+	metrics.GC(report, time.Since(start))
+	return report, nil
 }
 
 func (gc *GC) Stop() {
 	cmd <- STOP
 }
 
-func (gc *GC) doGCRecent(tx *bolt.Tx) {
+// doGCRecent trims the recent listing to the configured retention count.
+// Trimmed images are still reachable, just no longer listed.
+func (gc *GC) doGCRecent(tx *bolt.Tx) int {
 	index := 0
 	bucket := tx.Bucket(B(RECENT_BUCKET))
 	c := bucket.Cursor()
-	var k, v []byte
+	var k []byte
+	var trim [][]byte
 
-	// Skip ahead by RECENT_LIMIT and start deleting
-	for k, v = c.Last(); index < RECENT_LIMIT; k, v = c.Prev() {
+	// Skip ahead by the retention count and start deleting
+	for k, _ = c.Last(); k != nil && index < cfg.recentRetention; k, _ = c.Prev() {
 		index++
 	}
 
-	for ; k != nil; k, v = c.Prev() {
+	for ; k != nil; k, _ = c.Prev() {
+		trim = append(trim, append([]byte{}, k...))
+	}
+	for _, k := range trim {
 		// Remove from recent bucket
 		bucket.Delete(k)
-		image, err := gc.dao.Load(string(v))
-		if image != nil && err == nil {
-			// Delete thumbnail used with the "recent" view
-			gc.fs.DeleteThumbnail(image)
-		} else {
-			gc.logger.Println("Error during GC", err)
-		}
 	}
+	return len(trim)
+}
+
+// doGCQuotas drops upload usage from before today.
+func (gc *GC) doGCQuotas(tx *bolt.Tx) {
+	today := time.Now().UTC().Format(QUOTA_DAY)
+	bucket := tx.Bucket(B(QUOTA_BUCKET))
+	c := bucket.Cursor()
+	var old [][]byte
+	for k, _ := c.First(); k != nil && string(k) < today; k, _ = c.Next() {
+		old = append(old, append([]byte{}, k...))
+	}
+	// Deleting under the cursor would skip the key after each one deleted.
+	for _, k := range old {
+		bucket.Delete(k)
+	}
+}
+
+// doGCCache records recent thumbnail and variant accesses and deletes the
+// least recently used ones once the cache is over budget. They are
+// regenerated from the original on the next request. Pending accesses are
+// kept in memory on a dry run, as the transaction will be rolled back.
+func (gc *GC) doGCCache(tx *bolt.Tx, dryRun bool) []string {
+	if !dryRun {
+		gc.fs.cache.Flush(tx, gc.fs.storage)
+	}
+	evicted := gc.fs.cache.Evict(tx)
+	if len(evicted) > 0 {
+		gc.logger.Printf("GC Evicting %d cached files\n", len(evicted))
+	}
+	return evicted
 }
 
-func (gc *GC) doGCExpired(tx *bolt.Tx) {
+// doGCExpired removes images past their expiration and returns their UUIDs
+// along with the storage keys no longer referenced.
+func (gc *GC) doGCExpired(tx *bolt.Tx) ([]string, []string) {
+	var expired, orphaned []string
 	counter := 0
 	now := time.Now().UTC().Format(time.RFC3339)
 	bucket := tx.Bucket(B(EXPIRATION_BUCKET))
@@ -105,7 +200,7 @@ func (gc *GC) doGCExpired(tx *bolt.Tx) {
 		// Split string on comma
 		uuids := strings.Split(string(v), ",")
 		for _, uuid := range uuids {
-			image, err := gc.dao.Load(string(uuid))
+			image, err := getImage(tx.Bucket(B(IMAGE_BUCKET)), uuid)
 			if err != nil || image == nil {
 				gc.logger.Printf("Error loading image for GC. Deleting entry [UUID:%s]\n", string(uuid))
 				c.Delete()
@@ -113,12 +208,15 @@ func (gc *GC) doGCExpired(tx *bolt.Tx) {
 			} else {
 				gc.logger.Printf("GC Expired image [UUID:%s]\n", string(uuid))
 				c.Delete()
-				gc.dao.DeleteWithTx(image, tx)
-				err := gc.fs.Delete(image)
+				orphans, err := gc.dao.DeleteWithTx(image, tx)
 				if err != nil {
-					gc.logger.Printf("Error deleting image from disk for GC: %s\n", err)
+					gc.logger.Printf("Error deleting image for GC: %s\n", err)
+					continue
 				}
+				expired = append(expired, image.UUID)
+				orphaned = append(orphaned, orphans...)
 			}
 		}
 	}
+	return expired, orphaned
 }
@@ -1,22 +1,37 @@
 module github.com/bostrt/goimg
 
-go 1.15
+go 1.22.2
 
 require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/GeertJohan/go.rice v1.0.3
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/boltdb/bolt v1.3.1
 	github.com/corona10/goimghdr v0.0.0-20190614101314-9af2afa93d77
 	github.com/disintegration/imaging v1.6.2
-	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/julienschmidt/httprouter v1.3.0
-	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/spf13/cobra v1.6.1
 	github.com/spf13/viper v1.15.0
-	github.com/stretchr/testify v1.8.1 // indirect
 	github.com/teris-io/shortid v0.0.0-20220617161101-71ec9f2aa569
 	github.com/unrolled/logger v0.0.0-20201216141554-31a3694fe979
-	golang.org/x/image v0.5.0 // indirect
+	golang.org/x/image v0.5.0
+)
+
+require (
+	github.com/daaku/go.zipexe v1.0.2 // indirect
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/magiconair/properties v1.8.7 // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/pelletier/go-toml/v2 v2.0.6 // indirect
+	github.com/spf13/afero v1.9.3 // indirect
+	github.com/spf13/cast v1.5.0 // indirect
+	github.com/spf13/jwalterweatherman v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/subosito/gotenv v1.4.2 // indirect
 	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/text v0.7.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	gopkg.in/ini.v1 v1.67.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
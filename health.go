@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+)
+
+var errFreeSpaceUnsupported = errors.New("free space is not reported on this platform")
+
+// HealthCheck is the outcome of one readiness check.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Healthz answers as long as the process is serving requests.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz checks the database, the data directory and GC, and answers 503
+// with the failing checks if any of them fails.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	result := &readiness{Ready: true}
+	for _, check := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"database", s.checkDatabase},
+		{"data", checkDataDir},
+		{"gc", s.checkGC},
+	} {
+		hc := HealthCheck{Name: check.name, OK: true}
+		if err := check.fn(); err != nil {
+			hc.OK = false
+			hc.Error = err.Error()
+			result.Ready = false
+		}
+		result.Checks = append(result.Checks, hc)
+	}
+
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeJSON(w, status, result)
+}
+
+// checkDatabase reads the schema version, which fails once the database
+// is closed.
+func (s *Server) checkDatabase() error {
+	return s.imageDao.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(B(META_BUCKET))
+		if meta == nil || meta.Get(B(SCHEMA_KEY)) == nil {
+			return errors.New("schema version is missing")
+		}
+		return nil
+	})
+}
+
+// checkDataDir writes a file to the data directory, where uploads are
+// staged whatever the storage backend, and checks its free space.
+func checkDataDir() error {
+	tmp, err := ioutil.TempFile(cfg.data, ".ready-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString("ok")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	free, err := freeSpace(cfg.data)
+	if err == errFreeSpaceUnsupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if min := uint64(cfg.minFreeSpace) * 1024 * 1024; free < min {
+		return fmt.Errorf("%d MB free, below the minimum of %d MB", free/1024/1024, cfg.minFreeSpace)
+	}
+	return nil
+}
+
+// checkGC fails if the GC goroutine hasn't ticked for two intervals, which
+// means it has stopped or a run is stuck.
+func (s *Server) checkGC() error {
+	if s.gc == nil {
+		return errors.New("not running")
+	}
+	interval := time.Duration(cfg.gcInterval) * time.Second
+	if since := time.Since(s.gc.LastTick()); since > 2*interval {
+		return fmt.Errorf("last ticked %s ago", since.Round(time.Second))
+	}
+	return nil
+}
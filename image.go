@@ -6,6 +6,7 @@ import (
 
 type Image struct {
 	UUID      string
+	Seq       int // Upload order, assigned when first saved
 	path      string
 	thumbPath string
 	Added     string // RFC3339
@@ -14,25 +15,15 @@ type Image struct {
 	Delete    string
 	Owner     string
 	cookie    string
+	Token     string            // Name of the API token it was uploaded with
+	Metadata  map[string]string // Camera settings kept from stripped metadata
+	Frames    int               // Animation frames, 0 for still images
+	Duration  int               // Milliseconds of one loop of an animation
+	Hash      string            // Perceptual hash of the thumbnail, hex
 	RecentKey []byte
 }
 
 func NewImage(owner string, UUID string, path string, thumbPath string, unlisted bool, expire string, delete string, cookie string) *Image {
-	now := time.Now()
-	var eternity bool = false
-	switch expire {
-	case "day":
-		now = now.AddDate(0, 0, 1)
-		break
-	case "month":
-		now = now.AddDate(0, 1, 0)
-		break
-	case "forever":
-		eternity = true
-		break
-	default:
-		now = now.AddDate(0, 1, 0) // month
-	}
 	image := &Image{
 		Owner:     owner,
 		UUID:      UUID,
@@ -40,13 +31,30 @@ func NewImage(owner string, UUID string, path string, thumbPath string, unlisted
 		thumbPath: thumbPath,
 		Added:     time.Now().UTC().Format(time.RFC3339),
 		Unlisted:  unlisted,
+		Expires:   Expiration(expire),
 		Delete:    delete,
 		cookie:    cookie,
 	}
 
-	if !eternity {
-		image.Expires = now.UTC().Format(time.RFC3339)
-	}
-
 	return image
 }
+
+// Expiration converts an expire choice ("day", "month" or "forever") into
+// an RFC3339 timestamp counted from now. Forever returns an empty string
+// and anything unrecognized defaults to a month.
+func Expiration(expire string) string {
+	now := time.Now()
+	switch expire {
+	case "day":
+		now = now.AddDate(0, 0, 1)
+		break
+	case "month":
+		now = now.AddDate(0, 1, 0)
+		break
+	case "forever":
+		return ""
+	default:
+		now = now.AddDate(0, 1, 0) // month
+	}
+	return now.UTC().Format(time.RFC3339)
+}
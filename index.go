@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+const (
+	OWNER_INDEX_BUCKET  string = "owners"
+	COOKIE_INDEX_BUCKET string = "cookies"
+	GALLERY_PAGE_SIZE   int    = 20
+)
+
+// Secondary indexes map an owner name or uploader cookie to the images
+// carrying it. Each value gets a nested bucket keyed by the image sequence
+// number, so listing newest first and resuming from a cursor are both
+// cursor walks.
+
+// addToIndexes records image in the owner and cookie indexes.
+func addToIndexes(tx *bolt.Tx, image *Image) error {
+	if err := indexPut(tx, OWNER_INDEX_BUCKET, image.Owner, image); err != nil {
+		return err
+	}
+	return indexPut(tx, COOKIE_INDEX_BUCKET, image.cookie, image)
+}
+
+// removeFromIndexes drops image from the owner and cookie indexes.
+func removeFromIndexes(tx *bolt.Tx, image *Image) error {
+	if err := indexDelete(tx, OWNER_INDEX_BUCKET, image.Owner, image); err != nil {
+		return err
+	}
+	return indexDelete(tx, COOKIE_INDEX_BUCKET, image.cookie, image)
+}
+
+func indexPut(tx *bolt.Tx, index string, value string, image *Image) error {
+	if value == "" || image.Seq == 0 {
+		return nil
+	}
+	bucket, err := tx.Bucket(B(index)).CreateBucketIfNotExists(B(value))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(itob(image.Seq), B(image.UUID))
+}
+
+func indexDelete(tx *bolt.Tx, index string, value string, image *Image) error {
+	if value == "" || image.Seq == 0 {
+		return nil
+	}
+	parent := tx.Bucket(B(index))
+	bucket := parent.Bucket(B(value))
+	if bucket == nil {
+		return nil
+	}
+	if err := bucket.Delete(itob(image.Seq)); err != nil {
+		return err
+	}
+	if k, _ := bucket.Cursor().First(); k == nil {
+		return parent.DeleteBucket(B(value))
+	}
+	return nil
+}
+
+// ListByOwner returns up to limit listed images uploaded under owner,
+// newest first, starting before the sequence number before (0 for the
+// newest). The second return value is the cursor for the next page, 0 when
+// there are no more images.
+func (dao *ImageDao) ListByOwner(owner string, before int, limit int) ([]*Image, int) {
+	return dao.listIndex(OWNER_INDEX_BUCKET, owner, before, limit, func(image *Image) bool {
+		return !image.Unlisted
+	})
+}
+
+// ListByCookie returns the images uploaded with cookie, listed or not. See
+// ListByOwner for paging.
+func (dao *ImageDao) ListByCookie(cookie string, before int, limit int) ([]*Image, int) {
+	return dao.listIndex(COOKIE_INDEX_BUCKET, cookie, before, limit, func(image *Image) bool {
+		return true
+	})
+}
+
+func (dao *ImageDao) listIndex(index string, value string, before int, limit int, include func(*Image) bool) ([]*Image, int) {
+	var images []*Image
+	var next int
+	dao.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(index)).Bucket(B(value))
+		if bucket == nil || value == "" {
+			return nil
+		}
+		imageBucket := tx.Bucket(B(IMAGE_BUCKET))
+
+		walkNewest(bucket, before, func(seq int, UUID string) bool {
+			if len(images) == limit {
+				next = images[len(images)-1].Seq
+				return false
+			}
+			image, err := getImage(imageBucket, UUID)
+			if err != nil || image == nil {
+				dao.logger.Printf("Dangling %s index entry [UUID:%s]\n", index, UUID)
+				return true
+			}
+			if include(image) {
+				images = append(images, image)
+			}
+			return true
+		})
+		return nil
+	})
+	return images, next
+}
+
+// walkNewest calls fn for each sequence number and UUID in bucket from the
+// newest down, starting below before unless it is 0, until fn returns
+// false.
+func walkNewest(bucket *bolt.Bucket, before int, fn func(seq int, UUID string) bool) {
+	c := bucket.Cursor()
+	var k, v []byte
+	if before > 0 {
+		c.Seek(itob(before))
+		k, v = c.Prev()
+	} else {
+		k, v = c.Last()
+	}
+	for ; k != nil; k, v = c.Prev() {
+		if !fn(btoi(k), string(v)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// Daily upload usage, keyed by UTC day and client, e.g.
+	// "2006-01-02/ip:192.0.2.1"
+	QUOTA_BUCKET string = "quotas"
+
+	QUOTA_DAY string = "2006-01-02"
+)
+
+// remoteAddressHeaders carry the client address when goimg is behind a
+// proxy. The request log shows them as sent, upload limits only believe
+// them from a trusted proxy.
+var remoteAddressHeaders = []string{"X-Forwarded-For"}
+
+// uploadClients returns the keys an upload is limited under and their
+// daily limits: the API token's if it carries one, otherwise the client's
+// address and its goimg cookie.
+func uploadClients(r *http.Request, token *Token, proxies TrustedProxies) ([]string, *Quota) {
+	if token != nil {
+		return []string{"token:" + token.Name}, &Quota{
+			Count: token.QuotaUploads,
+			Bytes: int64(token.QuotaBytes) * 1024 * 1024,
+		}
+	}
+	clients := []string{
+		"ip:" + clientIP(r, proxies),
+		"cookie:" + r.Context().Value(AppCookie).(string),
+	}
+	return clients, &Quota{
+		Count: cfg.quotaUploads,
+		Bytes: int64(cfg.quotaBytes) * 1024 * 1024,
+	}
+}
+
+// TrustedProxies are the networks of proxies whose forwarding headers are
+// believed.
+type TrustedProxies []*net.IPNet
+
+// NewTrustedProxies parses comma separated addresses and CIDR ranges.
+func NewTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy is not an address or CIDR range: %s", entry)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy is not an address or CIDR range: %s", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Contains reports whether addr is one of the proxies.
+func (proxies TrustedProxies) Contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from. When that is a
+// trusted proxy, it is the right-most forwarded address that isn't one,
+// since clients can put anything in front of what the proxies append.
+func clientIP(r *http.Request, proxies TrustedProxies) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !proxies.Contains(addr) {
+		return addr
+	}
+	var hops []string
+	for _, header := range remoteAddressHeaders {
+		for _, val := range r.Header.Values(header) {
+			hops = append(hops, strings.Split(val, ",")...)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !proxies.Contains(hop) {
+			return hop
+		}
+		addr = hop
+	}
+	return addr
+}
+
+// RateLimiter keeps a token bucket per client in memory. Each bucket holds
+// up to burst tokens and refills at rate tokens per second.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows perMinute requests a minute per client, and up to
+// burst at once. A perMinute of 0 disables limiting.
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		pruned:  time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of every one of keys if they all
+// have one. Otherwise it takes nothing and returns how long until they do.
+func (rl *RateLimiter) Allow(keys ...string) (bool, time.Duration) {
+	if rl.rate <= 0 {
+		return true, 0
+	}
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+	var wait float64
+	for _, key := range keys {
+		b := rl.refill(key, now)
+		if b.tokens < 1 {
+			wait = math.Max(wait, (1-b.tokens)/rl.rate)
+		}
+	}
+	if wait > 0 {
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	for _, key := range keys {
+		rl.buckets[key].tokens--
+	}
+	return true, 0
+}
+
+func (rl *RateLimiter) refill(key string, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	return b
+}
+
+// prune forgets buckets that have refilled completely, at most once a
+// minute, so idle clients don't pile up.
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.pruned) < time.Minute {
+		return
+	}
+	rl.pruned = now
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Quota is one client's usage on one day, or the most it may use.
+type Quota struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ChargeQuota adds an upload of size bytes to the usage of each of clients
+// on day. If that would take any of them over limit nothing is charged and
+// it returns false. A size of 0 only checks that another upload may start.
+func (dao *ImageDao) ChargeQuota(clients []string, day string, size int64, limit *Quota) (bool, error) {
+	if limit.Count <= 0 && limit.Bytes <= 0 {
+		return true, nil
+	}
+	allowed := true
+	err := dao.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(QUOTA_BUCKET))
+		usage := make([]*Quota, len(clients))
+		for i, client := range clients {
+			usage[i] = &Quota{}
+			if v := bucket.Get(B(day + "/" + client)); v != nil {
+				if err := json.Unmarshal(v, usage[i]); err != nil {
+					return err
+				}
+			}
+			if !quotaFits(usage[i], size, limit) {
+				allowed = false
+				return nil
+			}
+		}
+		if size == 0 {
+			return nil
+		}
+		for i, client := range clients {
+			usage[i].Count++
+			usage[i].Bytes += size
+			v, err := json.Marshal(usage[i])
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(B(day+"/"+client), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return allowed, err
+}
+
+// RefundQuota takes an upload of size bytes charged on day back off the
+// usage of each of clients.
+func (dao *ImageDao) RefundQuota(clients []string, day string, size int64, limit *Quota) error {
+	if limit.Count <= 0 && limit.Bytes <= 0 {
+		return nil
+	}
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(QUOTA_BUCKET))
+		for _, client := range clients {
+			v := bucket.Get(B(day + "/" + client))
+			if v == nil {
+				continue
+			}
+			usage := &Quota{}
+			if err := json.Unmarshal(v, usage); err != nil {
+				return err
+			}
+			usage.Count = max(usage.Count-1, 0)
+			usage.Bytes = max(usage.Bytes-size, 0)
+			v, err := json.Marshal(usage)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(B(day+"/"+client), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func quotaFits(usage *Quota, size int64, limit *Quota) bool {
+	if limit.Count > 0 && usage.Count >= limit.Count {
+		return false
+	}
+	// With size 0, check there is at least a byte left
+	if size == 0 {
+		size = 1
+	}
+	return limit.Bytes <= 0 || usage.Bytes+size <= limit.Bytes
+}
+
+// untilTomorrow returns the time left until quotas reset at midnight UTC.
+func untilTomorrow() time.Duration {
+	now := time.Now().UTC()
+	return now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
+
+// limitUploads checks the rate limit and quotas before an upload is read,
+// setting Retry-After if it has to wait. Uploads with an API token are
+// only held to the token's quotas.
+func (s *Server) limitUploads(w http.ResponseWriter, token *Token, clients []string, limit *Quota) error {
+	if token == nil {
+		if ok, wait := s.limiter.Allow(clients...); !ok {
+			setRetryAfter(w, wait)
+			return &APIError{http.StatusTooManyRequests, "rate_limited", "Too many uploads, try again later"}
+		}
+	}
+	_, err := s.chargeQuota(w, clients, limit, 0)
+	return err
+}
+
+// chargeQuota charges an upload of size bytes to clients' daily quotas. It
+// returns a func taking the charge back, for uploads that fail after it.
+func (s *Server) chargeQuota(w http.ResponseWriter, clients []string, limit *Quota, size int64) (func(), error) {
+	day := time.Now().UTC().Format(QUOTA_DAY)
+	ok, err := s.imageDao.ChargeQuota(clients, day, size, limit)
+	if err != nil {
+		s.logger.Println("Error checking upload quota:", err)
+		return nil, &APIError{http.StatusInternalServerError, "save_failed", "Could not check upload quota"}
+	}
+	if !ok {
+		setRetryAfter(w, untilTomorrow())
+		return nil, &APIError{http.StatusTooManyRequests, "quota_exceeded", "Daily upload quota exceeded, resets at midnight UTC"}
+	}
+	refund := func() {
+		if err := s.imageDao.RefundQuota(clients, day, size, limit); err != nil {
+			s.logger.Println("Error refunding upload quota:", err)
+		}
+	}
+	return refund, nil
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
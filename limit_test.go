@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		taken     int           // Uploads made at once
+		elapsed   time.Duration // Time since then
+		want      int           // Uploads allowed next, at once
+	}{
+		{"within burst", 60, 3, 2, 0, 1},
+		{"burst used up", 60, 3, 3, 0, 0},
+		{"refilled a token", 60, 3, 3, time.Second, 1},
+		{"half a token", 60, 3, 3, 500 * time.Millisecond, 0},
+		{"refill capped at burst", 60, 2, 2, time.Hour, 2},
+		{"slow rate", 1, 1, 1, 30 * time.Second, 0},
+		{"slow rate refilled", 1, 1, 1, time.Minute, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := NewRateLimiter(test.perMinute, test.burst)
+			for i := 0; i < test.taken; i++ {
+				if ok, _ := rl.Allow("ip:192.0.2.1"); !ok {
+					t.Fatalf("upload %d refused within the burst", i+1)
+				}
+			}
+			b := rl.buckets["ip:192.0.2.1"]
+			b.last = b.last.Add(-test.elapsed)
+
+			allowed := 0
+			for {
+				ok, wait := rl.Allow("ip:192.0.2.1")
+				if !ok {
+					if wait <= 0 {
+						t.Error("refused without a wait")
+					}
+					break
+				}
+				allowed++
+			}
+			if allowed != test.want {
+				t.Errorf("allowed %d uploads, want %d", allowed, test.want)
+			}
+		})
+	}
+
+	rl := NewRateLimiter(0, 1)
+	for i := 0; i < 100; i++ {
+		if ok, _ := rl.Allow("ip:192.0.2.1"); !ok {
+			t.Fatal("refused with limiting disabled")
+		}
+	}
+}
+
+func TestRateLimiterAllKeys(t *testing.T) {
+	rl := NewRateLimiter(60, 1)
+	if ok, _ := rl.Allow("ip:192.0.2.1", "cookie:a"); !ok {
+		t.Fatal("first upload refused")
+	}
+	// A new cookie from the same address is still held to the address.
+	if ok, _ := rl.Allow("ip:192.0.2.1", "cookie:b"); ok {
+		t.Fatal("allowed with the address out of tokens")
+	}
+	// Nothing is taken from cookie:b when refused.
+	if ok, _ := rl.Allow("ip:192.0.2.2", "cookie:b"); !ok {
+		t.Fatal("refused cookie charged for a refused upload")
+	}
+}
+
+func TestQuotaDayRollover(t *testing.T) {
+	dao := newTestDao(t)
+	clients := []string{"ip:192.0.2.1", "cookie:a"}
+	limit := &Quota{Count: 2, Bytes: 1000}
+
+	tests := []struct {
+		name string
+		day  string
+		size int64
+		want bool
+	}{
+		{"first upload", "2020-01-01", 400, true},
+		{"second upload", "2020-01-01", 400, true},
+		{"over count", "2020-01-01", 1, false},
+		{"next day", "2020-01-02", 900, true},
+		{"over bytes", "2020-01-02", 200, false},
+		{"check only", "2020-01-02", 0, true},
+		{"day after", "2020-01-03", 1000, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := dao.ChargeQuota(clients, test.day, test.size, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.want {
+				t.Fatalf("allowed %v, want %v", ok, test.want)
+			}
+		})
+	}
+
+	// Refunding gives the charge back.
+	if err := dao.RefundQuota(clients, "2020-01-03", 1000, limit); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := dao.ChargeQuota(clients, "2020-01-03", 1000, limit); !ok {
+		t.Error("refunded upload still counted")
+	}
+
+	// GC drops every day before today.
+	today := time.Now().UTC().Format(QUOTA_DAY)
+	if ok, _ := dao.ChargeQuota(clients, today, 1, limit); !ok {
+		t.Fatal("upload today refused")
+	}
+	err := dao.db.Update(func(tx *bolt.Tx) error {
+		(&GC{}).doGCQuotas(tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	dao.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(B(QUOTA_BUCKET)).ForEach(func(k, v []byte) error {
+			left = append(left, string(k))
+			return nil
+		})
+	})
+	if len(left) != len(clients) || left[0] != today+"/"+clients[1] || left[1] != today+"/"+clients[0] {
+		t.Errorf("quota keys after GC = %v, want only today's", left)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := NewTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"header from untrusted address", "198.51.100.7:1234", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed left-most entry", "10.1.2.3:1234", []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"chain of proxies", "10.1.2.3:1234", []string{"1.2.3.4, 203.0.113.9, 192.0.2.1, 10.9.9.9"}, "203.0.113.9"},
+		{"repeated headers", "10.1.2.3:1234", []string{"1.2.3.4", "203.0.113.9"}, "203.0.113.9"},
+		{"only proxies", "10.1.2.3:1234", []string{"10.2.2.2"}, "10.2.2.2"},
+		{"proxy without header", "192.0.2.1:1234", nil, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/upload", nil)
+			r.RemoteAddr = test.remote
+			for _, val := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", val)
+			}
+			if got := clientIP(r, proxies); got != test.want {
+				t.Errorf("clientIP = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	if _, err = NewTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("accepted a bad CIDR range")
+	}
+	if _, err = NewTrustedProxies("proxy.example.com"); err == nil {
+		t.Error("accepted a host name")
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/spf13/cobra"
@@ -20,16 +25,18 @@ var (
 
 func main() {
 
-	// The sole command
+	// Without a subcommand goimg serves, as it always has
 	var rootCmd = &cobra.Command{
-		Use:   "goimg",
-		Short: "",
-		Long:  "",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("Starting on %s...\n", cfg.bind)
-			run()
+		Use:           "goimg",
+		Short:         "Simple image hosting",
+		Long:          "",
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return serve()
 		},
 	}
+	rootCmd.AddCommand(newServeCmd(), newGCCmd(), newImagesCmd(), newStatsCmd(), newFsckCmd(), newBackupCmd(), newRestoreCmd(), newExportCmd(), newImportCmd(), newTokensCmd())
 	// Setup command line arguments and link to config file properties
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file")
@@ -38,11 +45,81 @@ func main() {
 	rootCmd.PersistentFlags().StringVarP(&cfg.db, "db", "", "./test.db", "path to database")
 	rootCmd.PersistentFlags().IntVarP(&cfg.gcInterval, "gcinterval", "", 300, "garbage collection interval in seconds")
 	rootCmd.PersistentFlags().IntVarP(&cfg.gcLimit, "gclimit", "", 100, "garbage collection limit per run")
+	rootCmd.PersistentFlags().StringVarP(&cfg.adminToken, "admintoken", "", "", "bearer token for the /admin endpoints, besides API tokens with the admin scope")
+	rootCmd.PersistentFlags().StringVarP(&cfg.cookieKeys, "cookiekeys", "", "", "comma separated keys for signing cookies, the first signs and all verify; empty to generate one")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.cookieSecure, "cookiesecure", "", false, "mark cookies Secure even on plain HTTP requests, e.g. behind a TLS proxy")
+	rootCmd.PersistentFlags().StringVarP(&cfg.legacyCookies, "legacycookies", "", "", "last day, as YYYY-MM-DD, unsigned cookies from before signing are accepted once; empty to refuse them")
+	rootCmd.PersistentFlags().IntVarP(&cfg.minFreeSpace, "minfreespace", "", 100, "MB free in the data directory below which /readyz fails")
+	rootCmd.PersistentFlags().StringVarP(&cfg.trustedProxies, "trustedproxies", "", "", "comma separated addresses or CIDR ranges of proxies whose X-Forwarded-For is believed")
+	rootCmd.PersistentFlags().IntVarP(&cfg.uploadRate, "uploadrate", "", 10, "uploads a minute allowed per client, 0 for unlimited")
+	rootCmd.PersistentFlags().IntVarP(&cfg.uploadBurst, "uploadburst", "", 10, "uploads a client may make at once before the rate applies")
+	rootCmd.PersistentFlags().IntVarP(&cfg.quotaUploads, "quotauploads", "", 0, "uploads a day allowed per client, 0 for unlimited")
+	rootCmd.PersistentFlags().IntVarP(&cfg.quotaBytes, "quotabytes", "", 0, "MB a day a client may upload, 0 for unlimited")
+	rootCmd.PersistentFlags().IntVarP(&cfg.shutdownTimeout, "shutdowntimeout", "", 30, "seconds to let in-flight requests finish on shutdown")
+	rootCmd.PersistentFlags().IntVarP(&cfg.fsckInterval, "fsckinterval", "", 0, "background consistency check interval in seconds, 0 to disable")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.fsckRepair, "fsckrepair", "", false, "repair what the background consistency check finds")
+	rootCmd.PersistentFlags().IntVarP(&cfg.recentPageSize, "recentpagesize", "", 20, "images per page of the recent listing")
+	rootCmd.PersistentFlags().IntVarP(&cfg.recentRetention, "recentretention", "", 1000, "number of images kept in the recent listing")
+	rootCmd.PersistentFlags().StringVarP(&cfg.sizes, "sizes", "", "150x150,320x0,640x0,1280x0,1920x0", "allowed WxH sizes for resized images")
+	rootCmd.PersistentFlags().StringVarP(&cfg.qualities, "qualities", "", "50,75,90", "allowed JPEG qualities for resized images")
+	rootCmd.PersistentFlags().IntVarP(&cfg.maxWidth, "maxwidth", "", 16384, "widest image accepted in pixels, 0 for unlimited")
+	rootCmd.PersistentFlags().IntVarP(&cfg.maxHeight, "maxheight", "", 16384, "highest image accepted in pixels, 0 for unlimited")
+	rootCmd.PersistentFlags().IntVarP(&cfg.maxPixels, "maxpixels", "", 50, "largest image accepted in megapixels, 0 for unlimited")
+	rootCmd.PersistentFlags().IntVarP(&cfg.maxFrames, "maxframes", "", 500, "most frames accepted in an animated GIF, 0 for unlimited")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.stripMetadata, "stripmetadata", "", true, "strip EXIF, XMP and IPTC metadata from uploads and apply their orientation")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.keepMetadata, "keepmetadata", "", false, "keep camera settings from stripped metadata to show with the image")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.webp, "webp", "", true, "serve lossless WebP copies of thumbnails and resized images to browsers that accept them, when smaller")
+	rootCmd.PersistentFlags().StringVarP(&cfg.duplicates, "duplicates", "", DUPLICATES_ALLOW, "what to do with uploads that look like an earlier image: allow, warn or redirect")
+	rootCmd.PersistentFlags().IntVarP(&cfg.similarDistance, "similardistance", "", 10, "most bits of 64 in which the hashes of similar images differ")
+	rootCmd.PersistentFlags().IntVarP(&cfg.cacheSize, "cachesize", "", 1024, "MB of thumbnails and resized images to keep, 0 for unlimited")
+	rootCmd.PersistentFlags().StringVarP(&cfg.storage, "storage", "", STORAGE_DISK, "storage backend: disk or s3")
+	rootCmd.PersistentFlags().StringVarP(&cfg.s3Endpoint, "s3endpoint", "", "", "S3 endpoint URL, e.g. http://localhost:9000")
+	rootCmd.PersistentFlags().StringVarP(&cfg.s3Bucket, "s3bucket", "", "", "S3 bucket name")
+	rootCmd.PersistentFlags().StringVarP(&cfg.s3Region, "s3region", "", "us-east-1", "S3 region")
+	rootCmd.PersistentFlags().StringVarP(&cfg.s3AccessKey, "s3accesskey", "", "", "S3 access key")
+	rootCmd.PersistentFlags().StringVarP(&cfg.s3SecretKey, "s3secretkey", "", "", "S3 secret key")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.s3PathStyle, "s3pathstyle", "", true, "use path-style S3 bucket addressing")
+	rootCmd.PersistentFlags().StringVarP(&cfg.s3Prefix, "s3prefix", "", "", "prefix for this instance's S3 object keys, e.g. goimg/")
 	viper.BindPFlag("bind", rootCmd.PersistentFlags().Lookup("bind"))
 	viper.BindPFlag("data", rootCmd.PersistentFlags().Lookup("data"))
 	viper.BindPFlag("db", rootCmd.PersistentFlags().Lookup("db"))
 	viper.BindPFlag("gcinterval", rootCmd.PersistentFlags().Lookup("gcinterval"))
 	viper.BindPFlag("gclimit", rootCmd.PersistentFlags().Lookup("gclimit"))
+	viper.BindPFlag("admintoken", rootCmd.PersistentFlags().Lookup("admintoken"))
+	viper.BindPFlag("cookiekeys", rootCmd.PersistentFlags().Lookup("cookiekeys"))
+	viper.BindPFlag("cookiesecure", rootCmd.PersistentFlags().Lookup("cookiesecure"))
+	viper.BindPFlag("legacycookies", rootCmd.PersistentFlags().Lookup("legacycookies"))
+	viper.BindPFlag("minfreespace", rootCmd.PersistentFlags().Lookup("minfreespace"))
+	viper.BindPFlag("trustedproxies", rootCmd.PersistentFlags().Lookup("trustedproxies"))
+	viper.BindPFlag("uploadrate", rootCmd.PersistentFlags().Lookup("uploadrate"))
+	viper.BindPFlag("uploadburst", rootCmd.PersistentFlags().Lookup("uploadburst"))
+	viper.BindPFlag("quotauploads", rootCmd.PersistentFlags().Lookup("quotauploads"))
+	viper.BindPFlag("quotabytes", rootCmd.PersistentFlags().Lookup("quotabytes"))
+	viper.BindPFlag("shutdowntimeout", rootCmd.PersistentFlags().Lookup("shutdowntimeout"))
+	viper.BindPFlag("fsckinterval", rootCmd.PersistentFlags().Lookup("fsckinterval"))
+	viper.BindPFlag("fsckrepair", rootCmd.PersistentFlags().Lookup("fsckrepair"))
+	viper.BindPFlag("recentpagesize", rootCmd.PersistentFlags().Lookup("recentpagesize"))
+	viper.BindPFlag("recentretention", rootCmd.PersistentFlags().Lookup("recentretention"))
+	viper.BindPFlag("sizes", rootCmd.PersistentFlags().Lookup("sizes"))
+	viper.BindPFlag("qualities", rootCmd.PersistentFlags().Lookup("qualities"))
+	viper.BindPFlag("maxwidth", rootCmd.PersistentFlags().Lookup("maxwidth"))
+	viper.BindPFlag("maxheight", rootCmd.PersistentFlags().Lookup("maxheight"))
+	viper.BindPFlag("maxpixels", rootCmd.PersistentFlags().Lookup("maxpixels"))
+	viper.BindPFlag("maxframes", rootCmd.PersistentFlags().Lookup("maxframes"))
+	viper.BindPFlag("stripmetadata", rootCmd.PersistentFlags().Lookup("stripmetadata"))
+	viper.BindPFlag("keepmetadata", rootCmd.PersistentFlags().Lookup("keepmetadata"))
+	viper.BindPFlag("webp", rootCmd.PersistentFlags().Lookup("webp"))
+	viper.BindPFlag("duplicates", rootCmd.PersistentFlags().Lookup("duplicates"))
+	viper.BindPFlag("similardistance", rootCmd.PersistentFlags().Lookup("similardistance"))
+	viper.BindPFlag("cachesize", rootCmd.PersistentFlags().Lookup("cachesize"))
+	viper.BindPFlag("storage", rootCmd.PersistentFlags().Lookup("storage"))
+	viper.BindPFlag("s3endpoint", rootCmd.PersistentFlags().Lookup("s3endpoint"))
+	viper.BindPFlag("s3bucket", rootCmd.PersistentFlags().Lookup("s3bucket"))
+	viper.BindPFlag("s3region", rootCmd.PersistentFlags().Lookup("s3region"))
+	viper.BindPFlag("s3accesskey", rootCmd.PersistentFlags().Lookup("s3accesskey"))
+	viper.BindPFlag("s3secretkey", rootCmd.PersistentFlags().Lookup("s3secretkey"))
+	viper.BindPFlag("s3pathstyle", rootCmd.PersistentFlags().Lookup("s3pathstyle"))
+	viper.BindPFlag("s3prefix", rootCmd.PersistentFlags().Lookup("s3prefix"))
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -51,57 +128,149 @@ func main() {
 
 }
 
-func run() {
-	var wg sync.WaitGroup
+// instance is a database and storage opened from the configuration, shared
+// by the server and the offline commands.
+type instance struct {
+	db     *bolt.DB
+	dao    *ImageDao
+	fs     *FS
+	logger *logger.Logger
+}
 
-	// Validate directories
+// open validates the configured paths, opens and migrates the database and
+// sets up storage. A timeout of 0 waits for the database lock forever.
+func open(timeout time.Duration, out io.Writer) (*instance, error) {
+	if err := checkPaths(); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(cfg.db, 0600, &bolt.Options{Timeout: timeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("Database is locked, is another goimg running? %s", cfg.db)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error opening database: %s", err)
+	}
+
+	logger := newLogger(out)
+	// Ensure buckets are present and upgrade older databases.
+	if err = Migrate(db, logger); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error migrating database: %s", err)
+	}
+
+	storage, err := NewStorage(cfg)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error configuring storage: %s", err)
+	}
+	return &instance{
+		db:     db,
+		dao:    NewImageDao(db, logger),
+		fs:     NewFS(cfg, storage, logger),
+		logger: logger,
+	}, nil
+}
+
+// checkPaths validates the configured database and data directory paths.
+func checkPaths() error {
 	if _, err := os.Stat(filepath.Dir(cfg.db)); os.IsNotExist(err) {
-		fmt.Println("Database directory does not exist:", cfg.db)
-		return
+		return fmt.Errorf("Database directory does not exist: %s", cfg.db)
 	} else if finfo, _ := os.Stat(cfg.db); finfo != nil && finfo.IsDir() {
-		fmt.Println("Databsae location must not be a directory:", cfg.db)
-		return
+		return fmt.Errorf("Database location must not be a directory: %s", cfg.db)
 	}
 
 	if finfo, err := os.Stat(cfg.data); os.IsNotExist(err) {
-		fmt.Println("Data directory does not exist:", cfg.data)
-		return
+		return fmt.Errorf("Data directory does not exist: %s", cfg.data)
 	} else if !finfo.IsDir() {
-		fmt.Println("Data flag is not a directory:", cfg.data)
-		return
+		return fmt.Errorf("Data flag is not a directory: %s", cfg.data)
 	}
+	return nil
+}
 
-	fmt.Println("Opening database:", cfg.db)
-	db, err := bolt.Open(cfg.db, 0600, nil)
-        if err != nil {
-            fmt.Println("Error opening database", err)
-            return
-        }
-	defer db.Close()
-
-	logger := logger.New(logger.Options{
-		RemoteAddressHeaders: []string{"X-Forwarded-For"},
+func newLogger(out io.Writer) *logger.Logger {
+	return logger.New(logger.Options{
+		RemoteAddressHeaders: remoteAddressHeaders,
 		OutputFlags:          log.LstdFlags,
 		IgnoredRequestURIs:   []string{"/favicon.ico"},
+		Out:                  out,
 	})
-	dao := NewImageDao(db, logger)
-	fs := NewFS(cfg, logger)
-	gc := NewGC(db, dao, fs, &wg, logger)
+}
+
+func (in *instance) Close() error {
+	return in.db.Close()
+}
+
+func serve() error {
+	var wg sync.WaitGroup
 
+	fmt.Println("Opening database:", cfg.db)
+	in, err := open(lockTimeout, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	signer, err := NewCookieSigner(cfg.cookieKeys, cfg.legacyCookies, in.dao)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.duplicates {
+	case DUPLICATES_ALLOW, DUPLICATES_WARN, DUPLICATES_REDIRECT:
+	default:
+		return fmt.Errorf("Unknown duplicates setting: %s", cfg.duplicates)
+	}
+	proxies, err := NewTrustedProxies(cfg.trustedProxies)
+	if err != nil {
+		return err
+	}
+	similar, err := NewSimilarIndex(in.dao)
+	if err != nil {
+		return fmt.Errorf("Error indexing image hashes: %s", err)
+	}
+
+	gc := NewGC(in.db, in.dao, in.fs, &wg, in.logger)
+
+	wg.Add(1)
 	go gc.Start()
 
-	db.Update(func(tx *bolt.Tx) error {
-		// Ensure "recent" and "gc" buckets are present.
-		tx.CreateBucketIfNotExists(B(RECENT_BUCKET))
-		tx.CreateBucketIfNotExists(B(EXPIRATION_BUCKET))
-		tx.CreateBucketIfNotExists(B(IMAGE_BUCKET))
+	var fsck *Fsck
+	if cfg.fsckInterval > 0 {
+		fsck = NewFsck(in.db, in.dao, in.fs, in.logger)
+		go fsck.Start(time.Duration(cfg.fsckInterval)*time.Second, cfg.fsckRepair)
+	}
 
-		return nil
-	})
+	server := NewServer(in.dao, in.fs, gc, signer, similar, proxies, cfg, in.logger)
+	errs := make(chan error, 1)
+	go func() {
+		fmt.Printf("Starting on %s...\n", cfg.bind)
+		errs <- server.ListenAndServe()
+	}()
 
-	NewServer(dao, fs, cfg, logger).ListenAndServe()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
+	select {
+	case err = <-errs:
+		// Failed to listen, nothing is in flight yet.
+	case sig := <-signals:
+		in.logger.Printf("Received %s, shutting down\n", sig)
+		// Stop accepting connections and let in-flight requests finish,
+		// then stop the background jobs before the database is closed.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.shutdownTimeout)*time.Second)
+		defer cancel()
+		if err = server.Shutdown(ctx); err != nil {
+			in.logger.Printf("Error draining requests: %s\n", err)
+		}
+	}
+
+	gc.Stop()
+	if fsck != nil {
+		fsck.Stop()
+	}
 	wg.Wait()
+	return err
 }
 
 func initConfig() {
@@ -124,4 +293,39 @@ func initConfig() {
 	cfg.db = viper.GetString("db")
 	cfg.gcInterval = viper.GetInt("gcinterval")
 	cfg.gcLimit = viper.GetInt("gclimit")
+	cfg.adminToken = viper.GetString("admintoken")
+	cfg.cookieKeys = viper.GetString("cookiekeys")
+	cfg.cookieSecure = viper.GetBool("cookiesecure")
+	cfg.legacyCookies = viper.GetString("legacycookies")
+	cfg.minFreeSpace = viper.GetInt("minfreespace")
+	cfg.trustedProxies = viper.GetString("trustedproxies")
+	cfg.uploadRate = viper.GetInt("uploadrate")
+	cfg.uploadBurst = viper.GetInt("uploadburst")
+	cfg.quotaUploads = viper.GetInt("quotauploads")
+	cfg.quotaBytes = viper.GetInt("quotabytes")
+	cfg.shutdownTimeout = viper.GetInt("shutdowntimeout")
+	cfg.fsckInterval = viper.GetInt("fsckinterval")
+	cfg.fsckRepair = viper.GetBool("fsckrepair")
+	cfg.recentPageSize = viper.GetInt("recentpagesize")
+	cfg.recentRetention = viper.GetInt("recentretention")
+	cfg.sizes = viper.GetString("sizes")
+	cfg.qualities = viper.GetString("qualities")
+	cfg.maxWidth = viper.GetInt("maxwidth")
+	cfg.maxHeight = viper.GetInt("maxheight")
+	cfg.maxPixels = viper.GetInt("maxpixels")
+	cfg.maxFrames = viper.GetInt("maxframes")
+	cfg.stripMetadata = viper.GetBool("stripmetadata")
+	cfg.keepMetadata = viper.GetBool("keepmetadata")
+	cfg.webp = viper.GetBool("webp")
+	cfg.duplicates = viper.GetString("duplicates")
+	cfg.similarDistance = viper.GetInt("similardistance")
+	cfg.cacheSize = viper.GetInt("cachesize")
+	cfg.storage = viper.GetString("storage")
+	cfg.s3Endpoint = viper.GetString("s3endpoint")
+	cfg.s3Bucket = viper.GetString("s3bucket")
+	cfg.s3Region = viper.GetString("s3region")
+	cfg.s3AccessKey = viper.GetString("s3accesskey")
+	cfg.s3SecretKey = viper.GetString("s3secretkey")
+	cfg.s3PathStyle = viper.GetBool("s3pathstyle")
+	cfg.s3Prefix = viper.GetString("s3prefix")
 }
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+)
+
+// Metadata stripping rewrites an image without the chunks that describe
+// where, when and with what it was taken: EXIF, XMP, IPTC and comments.
+// Pixel data and what affects how it is displayed, such as ICC colour
+// profiles, are copied as they are, so nothing is re-encoded unless the
+// EXIF orientation has to be applied. Re-encoded images get the colour
+// profile back, and APNGs keep their animation. WebPs are re-encoded
+// lossless.
+
+const (
+	// Largest metadata block read into memory, anything longer is dropped
+	// unread
+	MAX_EXIF_SIZE int64 = 256 * 1024
+)
+
+// strippedMeta is what stripping found in an image.
+type strippedMeta struct {
+	exif     []byte   // TIFF structure of the first EXIF block, if any
+	icc      [][]byte // ICC profile segments or colour chunks, whole, to carry over on re-encoding
+	animated bool     // WebP with an ANIM chunk, which can't be decoded
+}
+
+// stripMetadata copies the image in r to w without metadata. fileType is
+// as detected by goimghdr, and only jpeg, png and webp are supported.
+func stripMetadata(fileType string, w io.Writer, r io.Reader) (*strippedMeta, error) {
+	switch fileType {
+	case "jpeg":
+		return stripJPEG(w, bufio.NewReader(r))
+	case "png":
+		return stripPNG(w, r)
+	case "webp":
+		return stripWebP(w, r)
+	}
+	return nil, ErrUnsupportedType
+}
+
+func canStripMetadata(fileType string) bool {
+	return fileType == "jpeg" || fileType == "png" || fileType == "webp"
+}
+
+// stripJPEG keeps JFIF (APP0), ICC profiles (APP2) and Adobe colour
+// information (APP14) and drops the other application segments and
+// comments. Anything after the end of the image, where some cameras append
+// previews with their own EXIF, is dropped too.
+func stripJPEG(w io.Writer, r *bufio.Reader) (*strippedMeta, error) {
+	meta := &strippedMeta{}
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, ErrDecode
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return nil, err
+	}
+
+	marker, err := nextMarker(r)
+	for err == nil {
+		switch {
+		case marker == 0xD9: // EOI
+			_, err = w.Write([]byte{0xFF, marker})
+			return meta, err
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01: // no length
+			if _, err = w.Write([]byte{0xFF, marker}); err != nil {
+				return nil, err
+			}
+			marker, err = nextMarker(r)
+			continue
+		}
+
+		var length [2]byte
+		if _, err = io.ReadFull(r, length[:]); err != nil {
+			return nil, ErrDecode
+		}
+		n := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return nil, ErrDecode
+		}
+
+		keep := true
+		switch {
+		case marker == 0xE1: // EXIF, XMP
+			keep = false
+			if meta.exif == nil && n <= MAX_EXIF_SIZE {
+				payload := make([]byte, n)
+				if _, err = io.ReadFull(r, payload); err != nil {
+					return nil, ErrDecode
+				}
+				if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+					meta.exif = payload[6:]
+				}
+				n = 0
+			}
+		case marker == 0xE2: // ICC profile, or FlashPix and MPF which go
+			payload := make([]byte, n)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return nil, ErrDecode
+			}
+			keep = bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+			if keep {
+				segment := append([]byte{0xFF, marker, length[0], length[1]}, payload...)
+				meta.icc = append(meta.icc, segment)
+				if _, err = w.Write(segment); err != nil {
+					return nil, err
+				}
+			}
+			marker, err = nextMarker(r)
+			continue
+		case marker >= 0xE3 && marker <= 0xEF && marker != 0xEE, marker == 0xFE: // IPTC, comments, ...
+			keep = false
+		}
+
+		if keep {
+			if _, err = w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+				return nil, err
+			}
+			if _, err = io.CopyN(w, r, n); err != nil {
+				return nil, ErrDecode
+			}
+		} else if _, err = io.CopyN(ioutil.Discard, r, n); err != nil {
+			return nil, ErrDecode
+		}
+
+		if marker == 0xDA { // SOS, entropy coded data follows
+			marker, err = copyScan(w, r)
+		} else {
+			marker, err = nextMarker(r)
+		}
+	}
+	if err == io.EOF {
+		err = ErrDecode
+	}
+	return nil, err
+}
+
+// nextMarker reads a marker, skipping fill bytes.
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, ErrDecode
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// copyScan copies entropy coded data up to the next marker other than a
+// restart marker, and returns that marker.
+func copyScan(w io.Writer, r *bufio.Reader) (byte, error) {
+	bw := bufio.NewWriter(w)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			bw.WriteByte(b)
+			continue
+		}
+		next, err := r.ReadByte()
+		for err == nil && next == 0xFF {
+			next, err = r.ReadByte()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+			bw.Write([]byte{0xFF, next})
+			continue
+		}
+		return next, bw.Flush()
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNG drops the eXIf, text and modification time chunks, and
+// anything after IEND. Colour chunks are kept and collected.
+func stripPNG(w io.Writer, r io.Reader) (*strippedMeta, error) {
+	meta := &strippedMeta{}
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return nil, ErrDecode
+	}
+	if _, err := w.Write(sig); err != nil {
+		return nil, err
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, ErrDecode
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4])) + 4 // with CRC
+		chunk := string(header[4:])
+		switch chunk {
+		case "eXIf":
+			if meta.exif == nil && n <= MAX_EXIF_SIZE {
+				payload := make([]byte, n)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return nil, ErrDecode
+				}
+				meta.exif = payload[:n-4]
+				continue
+			}
+			fallthrough
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+				return nil, ErrDecode
+			}
+			continue
+		case "iCCP", "sRGB", "gAMA", "cHRM":
+			if n > maxUploadSize {
+				return nil, ErrDecode
+			}
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, ErrDecode
+			}
+			chunk := append(header[:], payload...)
+			meta.icc = append(meta.icc, chunk)
+			if _, err := w.Write(chunk); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return nil, ErrDecode
+		}
+		if chunk == "IEND" {
+			return meta, nil
+		}
+	}
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears their flags in the
+// extended header. The ICC profile chunk is kept and collected.
+func stripWebP(w io.Writer, r io.Reader) (*strippedMeta, error) {
+	meta := &strippedMeta{}
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return nil, ErrDecode
+	}
+	// The RIFF size covers every chunk, so they are collected first.
+	size := int64(binary.LittleEndian.Uint32(header[4:8])) - 4
+	var body bytes.Buffer
+	for size > 0 {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, ErrDecode
+		}
+		n := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		padded := n + n%2
+		size -= 8 + padded
+		if padded > maxUploadSize {
+			return nil, ErrDecode
+		}
+		payload := make([]byte, padded)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, ErrDecode
+		}
+		switch string(chunk[:4]) {
+		case "EXIF":
+			if meta.exif == nil {
+				meta.exif = bytes.TrimPrefix(payload[:n], []byte("Exif\x00\x00"))
+			}
+			continue
+		case "XMP ":
+			continue
+		case "ICCP":
+			meta.icc = append(meta.icc, append(chunk[:], payload...))
+		case "ANIM":
+			meta.animated = true
+		case "VP8X":
+			if n > 0 {
+				payload[0] &^= 0x08 | 0x04 // EXIF and XMP present
+			}
+		}
+		body.Write(chunk[:])
+		body.Write(payload)
+	}
+	binary.LittleEndian.PutUint32(header[4:8], uint32(body.Len()+4))
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	_, err := body.WriteTo(w)
+	return meta, err
+}
+
+// orient applies an EXIF orientation to img.
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// withICC inserts ICC profile segments after the start of a JPEG.
+func withICC(jpeg []byte, icc [][]byte) []byte {
+	if len(icc) == 0 || len(jpeg) < 2 {
+		return jpeg
+	}
+	out := append([]byte{}, jpeg[:2]...)
+	for _, segment := range icc {
+		out = append(out, segment...)
+	}
+	return append(out, jpeg[2:]...)
+}
+
+// withPNGColour inserts colour chunks after the IHDR of a PNG, where they
+// must come before the palette and image data.
+func withPNGColour(png []byte, chunks [][]byte) []byte {
+	at := len(pngSignature) + 8 + 13 + 4 // IHDR with its length, type and CRC
+	if len(chunks) == 0 || len(png) < at {
+		return png
+	}
+	out := append([]byte{}, png[:at]...)
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	return append(out, png[at:]...)
+}
+
+// withWebPICC turns a simple lossless WebP, as nativewebp writes, into an
+// extended one carrying the ICC profile chunk.
+func withWebPICC(webp []byte, icc [][]byte) []byte {
+	if len(icc) == 0 || len(webp) < 25 || string(webp[12:16]) != "VP8L" {
+		return webp
+	}
+	// The VP8L header holds the size less one in 14 bits each, then
+	// whether there is alpha.
+	bits := binary.LittleEndian.Uint32(webp[21:25])
+	vp8x := make([]byte, 18)
+	copy(vp8x, "VP8X")
+	binary.LittleEndian.PutUint32(vp8x[4:], 10)
+	vp8x[8] = 0x20 // ICC profile present
+	if bits>>28&1 != 0 {
+		vp8x[8] |= 0x10 // alpha
+	}
+	putUint24(vp8x[12:], bits&0x3FFF)
+	putUint24(vp8x[15:], bits>>14&0x3FFF)
+
+	out := append([]byte{}, webp[:12]...)
+	out = append(out, vp8x...)
+	out = append(out, icc[0]...)
+	out = append(out, webp[12:]...)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// Metadata tags kept for display. Location, serial numbers and owner
+// names are never kept.
+const (
+	tagOrientation      = 0x0112
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagExifIFD          = 0x8769
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+)
+
+// exifInfo is what is read from an EXIF block.
+type exifInfo struct {
+	orientation int
+	display     map[string]string
+}
+
+// parseExif reads the orientation and the display tags from the TIFF
+// structure of an EXIF block. It reads what it can of a damaged block.
+func parseExif(tiff []byte) *exifInfo {
+	info := &exifInfo{orientation: 1, display: make(map[string]string)}
+	if len(tiff) < 8 {
+		return info
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info
+	}
+	t := &tiffReader{data: tiff, order: order}
+
+	tags := t.ifd(order.Uint32(tiff[4:8]))
+	if v, ok := tags[tagOrientation]; ok {
+		if o := t.uint(v); o >= 1 && o <= 8 {
+			info.orientation = int(o)
+		}
+	}
+	if v, ok := tags[tagExifIFD]; ok {
+		for tag, entry := range t.ifd(t.uint(v)) {
+			tags[tag] = entry
+		}
+	}
+
+	maker, model := t.ascii(tags[tagMake]), t.ascii(tags[tagModel])
+	if maker != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		model = maker + " " + model
+	}
+	set := func(name string, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			info.display[name] = value
+		}
+	}
+	set("Camera", model)
+	set("Lens", t.ascii(tags[tagLensModel]))
+	set("Taken", t.ascii(tags[tagDateTimeOriginal]))
+	if num, den := t.rational(tags[tagExposureTime]); den > 0 {
+		if num > 0 && num < den {
+			set("Exposure", fmt.Sprintf("1/%.0f s", float64(den)/float64(num)))
+		} else {
+			set("Exposure", formatFloat(float64(num)/float64(den))+" s")
+		}
+	}
+	if num, den := t.rational(tags[tagFNumber]); den > 0 {
+		set("Aperture", "f/"+formatFloat(float64(num)/float64(den)))
+	}
+	if num, den := t.rational(tags[tagFocalLength]); den > 0 {
+		set("Focal length", formatFloat(float64(num)/float64(den))+" mm")
+	}
+	if v, ok := tags[tagISO]; ok {
+		set("ISO", strconv.Itoa(int(t.uint(v))))
+	}
+	return info
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(math.Round(f*10)/10, 'f', -1, 64)
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the 4 byte value or offset field
+}
+
+func (t *tiffReader) ifd(offset uint32) map[uint16]tiffEntry {
+	tags := make(map[uint16]tiffEntry)
+	if int64(offset)+2 > int64(len(t.data)) {
+		return tags
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	for i := 0; i < n; i++ {
+		start := int64(offset) + 2 + int64(i)*12
+		if start+12 > int64(len(t.data)) {
+			break
+		}
+		e := t.data[start : start+12]
+		tags[t.order.Uint16(e)] = tiffEntry{
+			typ:   t.order.Uint16(e[2:]),
+			count: t.order.Uint32(e[4:]),
+			value: e[8:12],
+		}
+	}
+	return tags
+}
+
+// bytes returns the data of an entry of size bytes, stored inline or at an
+// offset.
+func (t *tiffReader) bytes(e tiffEntry, size int64) []byte {
+	if size <= 4 {
+		return e.value[:size]
+	}
+	offset := int64(t.order.Uint32(e.value))
+	if offset+size > int64(len(t.data)) {
+		return nil
+	}
+	return t.data[offset : offset+size]
+}
+
+func (t *tiffReader) uint(e tiffEntry) uint32 {
+	switch e.typ {
+	case 3: // SHORT
+		return uint32(t.order.Uint16(e.value))
+	case 4: // LONG
+		return t.order.Uint32(e.value)
+	}
+	return 0
+}
+
+func (t *tiffReader) ascii(e tiffEntry) string {
+	if e.typ != 2 || e.count == 0 || e.count > 256 {
+		return ""
+	}
+	return strings.TrimRight(string(t.bytes(e, int64(e.count))), "\x00")
+}
+
+func (t *tiffReader) rational(e tiffEntry) (uint32, uint32) {
+	if e.typ != 5 || e.count == 0 {
+		return 0, 0
+	}
+	b := t.bytes(e, 8)
+	if b == nil {
+		return 0, 0
+	}
+	return t.order.Uint32(b), t.order.Uint32(b[4:])
+}
+
+// sanitize replaces the staged original with a copy stripped of metadata
+// and turned upright, and returns the digest of the new contents.
+func (u *Upload) sanitize() (string, error) {
+	var meta *strippedMeta
+	digest, err := u.rewrite(func(w io.Writer, r io.Reader) (err error) {
+		meta, err = stripMetadata(u.Type, w, r)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	info := parseExif(meta.exif)
+	if u.fs.cfg.keepMetadata && len(info.display) > 0 {
+		u.Metadata = info.display
+	}
+	if info.orientation == 1 || meta.animated {
+		// Animated WebPs can't be decoded, so they keep their pixels as
+		// they are.
+		return digest, nil
+	}
+	return u.rewrite(func(w io.Writer, r io.Reader) error {
+		if u.Frames > 1 {
+			return u.orientAPNG(w, r, info.orientation, meta.icc)
+		}
+		img, err := decode(r, u.fs.cfg)
+		if err != nil {
+			return err
+		}
+		img = orient(img, info.orientation)
+		var buf bytes.Buffer
+		switch u.Type {
+		case "png":
+			if err = imaging.Encode(&buf, img, imaging.PNG); err != nil {
+				return err
+			}
+			_, err = w.Write(withPNGColour(buf.Bytes(), meta.icc))
+		case "webp":
+			if err = nativewebp.Encode(&buf, img, nil); err != nil {
+				return err
+			}
+			_, err = w.Write(withWebPICC(buf.Bytes(), meta.icc))
+		default:
+			if err = imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(95)); err != nil {
+				return err
+			}
+			_, err = w.Write(withICC(buf.Bytes(), meta.icc))
+		}
+		return err
+	})
+}
+
+// orientAPNG applies orientation to every frame of the APNG in r. One that
+// takes more than the pixel limit to decode is copied as it is.
+func (u *Upload) orientAPNG(w io.Writer, r io.Reader, orientation int, colour [][]byte) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	anim, err := scanAPNG(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return err
+	}
+	if u.fs.cfg.maxPixels > 0 && anim.pixels > int64(u.fs.cfg.maxPixels)*1000*1000 {
+		u.fs.logger.Println("Animation too large to turn upright, keeping it as it is")
+		_, err = w.Write(data)
+		return err
+	}
+	var buf bytes.Buffer
+	err = transformAPNG(&buf, data, 0, func(img image.Image) image.Image {
+		return orient(img, orientation)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(withPNGColour(buf.Bytes(), colour))
+	return err
+}
+
+// rewrite passes the staged original through fn into a new temporary file
+// that replaces it, and returns the digest of the new contents.
+func (u *Upload) rewrite(fn func(w io.Writer, r io.Reader) error) (string, error) {
+	src, err := os.Open(u.tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(u.fs.cfg.data, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	counter := &countingWriter{}
+	err = fn(io.MultiWriter(tmp, hash, counter), bufio.NewReader(src))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	os.Remove(u.tmpPath)
+	u.tmpPath, u.Size = tmp.Name(), counter.n
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
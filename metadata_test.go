@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/unrolled/logger"
+	"golang.org/x/image/webp"
+)
+
+// tiffTag is an entry of a handcrafted EXIF block. Values longer than four
+// bytes are stored after the directories.
+type tiffTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// buildTIFF lays out ifd0 and, if there are any, the exif tags in a
+// directory of their own that ifd0 points to.
+func buildTIFF(order tiffOrder, ifd0 []tiffTag, exif []tiffTag) []byte {
+	if exif != nil {
+		ifd0 = append(ifd0, tiffTag{tagExifIFD, 4, 1, nil})
+	}
+	size := func(tags []tiffTag) int { return 2 + 12*len(tags) + 4 }
+	exifOffset := 8 + size(ifd0)
+	dataOffset := exifOffset
+	if exif != nil {
+		dataOffset += size(exif)
+	}
+	var data []byte
+	ifd := func(tags []tiffTag) []byte {
+		b := make([]byte, size(tags))
+		order.PutUint16(b, uint16(len(tags)))
+		for i, tag := range tags {
+			e := b[2+12*i:]
+			order.PutUint16(e, tag.tag)
+			order.PutUint16(e[2:], tag.typ)
+			order.PutUint32(e[4:], tag.count)
+			switch {
+			case tag.tag == tagExifIFD:
+				order.PutUint32(e[8:], uint32(exifOffset))
+			case len(tag.value) <= 4:
+				copy(e[8:], tag.value)
+			default:
+				order.PutUint32(e[8:], uint32(dataOffset+len(data)))
+				data = append(data, tag.value...)
+			}
+		}
+		return b
+	}
+
+	out := []byte("MM\x00\x2a")
+	if order == binary.LittleEndian {
+		out = []byte("II\x2a\x00")
+	}
+	out = order.AppendUint32(out, 8)
+	out = append(out, ifd(ifd0)...)
+	if exif != nil {
+		out = append(out, ifd(exif)...)
+	}
+	return append(out, data...)
+}
+
+func shortTag(order tiffOrder, tag uint16, v uint16) tiffTag {
+	return tiffTag{tag, 3, 1, order.AppendUint16(nil, v)}
+}
+
+func asciiTag(tag uint16, s string) tiffTag {
+	return tiffTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func rationalTag(order tiffOrder, tag uint16, num uint32, den uint32) tiffTag {
+	return tiffTag{tag, 5, 1, order.AppendUint32(order.AppendUint32(nil, num), den)}
+}
+
+// orientationTIFF is an EXIF block holding only an orientation.
+func orientationTIFF(orientation uint16) []byte {
+	return buildTIFF(binary.BigEndian, []tiffTag{shortTag(binary.BigEndian, tagOrientation, orientation)}, nil)
+}
+
+func TestParseExif(t *testing.T) {
+	camera := func(order tiffOrder) []byte {
+		return buildTIFF(order, []tiffTag{
+			shortTag(order, tagOrientation, 6),
+			asciiTag(tagMake, "Canon"),
+			asciiTag(tagModel, "EOS 5D"),
+		}, []tiffTag{
+			rationalTag(order, tagExposureTime, 1, 250),
+			rationalTag(order, tagFNumber, 28, 10),
+			rationalTag(order, tagFocalLength, 50, 1),
+			shortTag(order, tagISO, 400),
+			asciiTag(tagDateTimeOriginal, "2020:01:02 03:04:05"),
+			asciiTag(tagLensModel, "EF50mm f/1.8"),
+		})
+	}
+	display := map[string]string{
+		"Camera":       "Canon EOS 5D",
+		"Lens":         "EF50mm f/1.8",
+		"Taken":        "2020:01:02 03:04:05",
+		"Exposure":     "1/250 s",
+		"Aperture":     "f/2.8",
+		"Focal length": "50 mm",
+		"ISO":          "400",
+	}
+	full := camera(binary.BigEndian)
+
+	tests := []struct {
+		name        string
+		tiff        []byte
+		orientation int
+		display     map[string]string
+	}{
+		{"big endian", full, 6, display},
+		{"little endian", camera(binary.LittleEndian), 6, display},
+		{"orientation only", orientationTIFF(3), 3, map[string]string{}},
+		{"orientation out of range", orientationTIFF(9), 1, map[string]string{}},
+		{"model includes make", buildTIFF(binary.BigEndian, []tiffTag{asciiTag(tagMake, "NIKON"), asciiTag(tagModel, "NIKON D750")}, nil), 1, map[string]string{"Camera": "NIKON D750"}},
+		{"long exposure", buildTIFF(binary.BigEndian, nil, []tiffTag{rationalTag(binary.BigEndian, tagExposureTime, 5, 2)}), 1, map[string]string{"Exposure": "2.5 s"}},
+		{"not a TIFF", []byte("JUNKJUNKJUNK"), 1, map[string]string{}},
+		{"empty", nil, 1, map[string]string{}},
+		{"cut after the first directory", full[:8+2+12*4+4], 6, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := parseExif(test.tiff)
+			if info.orientation != test.orientation {
+				t.Errorf("orientation = %d, want %d", info.orientation, test.orientation)
+			}
+			if !reflect.DeepEqual(info.display, test.display) {
+				t.Errorf("display = %v, want %v", info.display, test.display)
+			}
+		})
+	}
+}
+
+// jpegSegment returns a marker segment with its length.
+func jpegSegment(marker byte, payload string) []byte {
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	tiff := orientationTIFF(6)
+	jfif := jpegSegment(0xE0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")
+	icc := jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile")
+	adobe := jpegSegment(0xEE, "Adobe\x00\x64\x00\x00\x00\x00\x01")
+	dqt := jpegSegment(0xDB, "\x00quantization")
+	sos := jpegSegment(0xDA, "\x01\x01\x00\x00\x3f\x00")
+	scan := "\x12\x34\xFF\x00\x56\xFF\xD0\x78" // stuffed byte and a restart marker
+
+	var in bytes.Buffer
+	in.WriteString("\xFF\xD8")
+	in.Write(jfif)
+	in.Write(jpegSegment(0xE1, "Exif\x00\x00"+string(tiff)))
+	in.Write(jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	in.Write(icc)
+	in.Write(jpegSegment(0xE2, "FPXR\x00flashpix"))
+	in.Write(jpegSegment(0xED, "Photoshop 3.0\x00iptc"))
+	in.Write(adobe)
+	in.Write(jpegSegment(0xFE, "a comment"))
+	in.Write(dqt)
+	in.WriteString("\xFF\xFF") // fill bytes before a marker
+	in.Write(sos)
+	in.WriteString(scan)
+	in.WriteString("\xFF\xD9")
+	in.WriteString("\xFF\xD8\xFF\xE1trailing preview")
+
+	var out bytes.Buffer
+	meta, err := stripJPEG(&out, bufio.NewReader(&in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	want.WriteString("\xFF\xD8")
+	for _, segment := range [][]byte{jfif, icc, adobe, dqt, sos} {
+		want.Write(segment)
+	}
+	want.WriteString(scan)
+	want.WriteString("\xFF\xD9")
+	if !bytes.Equal(out.Bytes(), want.Bytes()) {
+		t.Errorf("stripped to\n%q\nwant\n%q", out.Bytes(), want.Bytes())
+	}
+	if !bytes.Equal(meta.exif, tiff) {
+		t.Errorf("exif = %q, want %q", meta.exif, tiff)
+	}
+	if len(meta.icc) != 1 || !bytes.Equal(meta.icc[0], icc) {
+		t.Errorf("icc = %q, want one segment %q", meta.icc, icc)
+	}
+
+	for _, bad := range []string{"", "GIF89a", "\xFF\xD8\xFF\xE1\x00", "\xFF\xD8\xFF\xDB\x00\x10short"} {
+		if _, err = stripJPEG(ioutil.Discard, bufio.NewReader(bytes.NewReader([]byte(bad)))); err == nil {
+			t.Errorf("stripped %q without an error", bad)
+		}
+	}
+}
+
+// pngChunk returns a chunk with its length and CRC.
+func pngChunk(chunk string, data string) []byte {
+	var buf bytes.Buffer
+	writePNGChunk(&buf, chunk, []byte(data))
+	return buf.Bytes()
+}
+
+func TestStripPNG(t *testing.T) {
+	tiff := orientationTIFF(8)
+	ihdr := pngChunk("IHDR", "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+	iccp := pngChunk("iCCP", "profile\x00\x00zlib")
+	srgb := pngChunk("sRGB", "\x00")
+	idat := pngChunk("IDAT", "pixels")
+	iend := pngChunk("IEND", "")
+
+	var in bytes.Buffer
+	in.Write(pngSignature)
+	for _, chunk := range [][]byte{ihdr, pngChunk("tIME", "\x07\xe4\x01\x02\x03\x04\x05"), iccp, srgb, pngChunk("eXIf", string(tiff)),
+		pngChunk("eXIf", "second"), pngChunk("tEXt", "Author\x00me"), pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x/>"), idat, iend} {
+		in.Write(chunk)
+	}
+	in.WriteString("trailing")
+
+	var out bytes.Buffer
+	meta, err := stripPNG(&out, &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Join([][]byte{pngSignature, ihdr, iccp, srgb, idat, iend}, nil)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("stripped to\n%q\nwant\n%q", out.Bytes(), want)
+	}
+	if !bytes.Equal(meta.exif, tiff) {
+		t.Errorf("exif = %q, want %q", meta.exif, tiff)
+	}
+	if !reflect.DeepEqual(meta.icc, [][]byte{iccp, srgb}) {
+		t.Errorf("colour chunks = %q, want iCCP and sRGB", meta.icc)
+	}
+
+	for _, bad := range []string{"", "\x89PNG\r\n\x1a\n", string(pngSignature) + string(ihdr[:10])} {
+		if _, err = stripPNG(ioutil.Discard, bytes.NewReader([]byte(bad))); err == nil {
+			t.Errorf("stripped %q without an error", bad)
+		}
+	}
+}
+
+// riffChunk returns a WebP chunk with its size and padding.
+func riffChunk(chunk string, data string) []byte {
+	b := append([]byte(chunk), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := bytes.Join(chunks, nil)
+	b := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	return append(append(b, "WEBP"...), body...)
+}
+
+func TestStripWebP(t *testing.T) {
+	tiff := orientationTIFF(3)
+	vp8x := func(flags byte) []byte {
+		return riffChunk("VP8X", string([]byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+	}
+	iccp := riffChunk("ICCP", "odd profile")
+	still := riffChunk("VP8L", "\x2fpixels")
+
+	in := riff(vp8x(0x20|0x08|0x04), iccp, still, riffChunk("EXIF", "Exif\x00\x00"+string(tiff)), riffChunk("XMP ", "<x:xmpmeta/>"))
+	var out bytes.Buffer
+	meta, err := stripWebP(&out, bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := riff(vp8x(0x20), iccp, still); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("stripped to\n%q\nwant\n%q", out.Bytes(), want)
+	}
+	if !bytes.Equal(meta.exif, tiff) {
+		t.Errorf("exif = %q, want %q", meta.exif, tiff)
+	}
+	if len(meta.icc) != 1 || !bytes.Equal(meta.icc[0], iccp) {
+		t.Errorf("icc = %q, want %q", meta.icc, iccp)
+	}
+	if meta.animated {
+		t.Error("still image taken for animated")
+	}
+
+	meta, err = stripWebP(ioutil.Discard, bytes.NewReader(riff(vp8x(0x02), riffChunk("ANIM", "\x00\x00\x00\x00\x00\x00"))))
+	if err != nil || !meta.animated {
+		t.Errorf("animation not noticed: %v", err)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("RIFF\x04\x00\x00\x00WAVE"), in[:len(in)-4]} {
+		if _, err = stripWebP(ioutil.Discard, bytes.NewReader(bad)); err == nil {
+			t.Errorf("stripped %q without an error", bad)
+		}
+	}
+}
+
+// testPixels is 3x2 with a red pixel top left, the others blue.
+func testPixels() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		img.Set(i%3, i/3, color.NRGBA{0, 0, 255, 255})
+	}
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	return img
+}
+
+// checkUpright checks that img is testPixels turned a quarter clockwise,
+// as EXIF orientation 6 asks for.
+func checkUpright(t *testing.T, img image.Image) {
+	t.Helper()
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 3 {
+		t.Fatalf("size %v, want 2x3", img.Bounds())
+	}
+	if r, _, _, _ := img.At(1, 0).RGBA(); r != 0xFFFF {
+		t.Errorf("top right pixel = %v, want red", img.At(1, 0))
+	}
+}
+
+func TestSanitizeOrientation(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFS(Config{data: dir, stripMetadata: true, maxPixels: 50}, NewDiskStorage(dir), logger.New(logger.Options{Out: ioutil.Discard}))
+	stage := func(data []byte) ([]byte, *Upload) {
+		upload, err := fs.Stage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(upload.Cleanup)
+		out, err := os.ReadFile(upload.tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, upload
+	}
+	exif := string(orientationTIFF(6))
+
+	t.Run("png", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, testPixels())
+		data := buf.Bytes()
+		at := len(pngSignature) + 25 // after IHDR
+		in := bytes.Join([][]byte{data[:at], pngChunk("iCCP", "profile\x00\x00zlib"), pngChunk("eXIf", exif), data[at:]}, nil)
+
+		out, _ := stage(in)
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkUpright(t, img)
+		if !bytes.Contains(out, []byte("iCCPprofile")) || bytes.Contains(out, []byte("eXIf")) {
+			t.Error("colour profile dropped or EXIF kept")
+		}
+	})
+
+	t.Run("apng", func(t *testing.T) {
+		pixels, err := apngData(testPixels())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fctl := func(seq byte) string {
+			return "\x00\x00\x00" + string(seq) + "\x00\x00\x00\x03\x00\x00\x00\x02" + "\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x01\x00\x0a\x00\x00"
+		}
+		in := bytes.Join([][]byte{
+			pngSignature,
+			pngChunk("IHDR", "\x00\x00\x00\x03\x00\x00\x00\x02\x08\x06\x00\x00\x00"),
+			pngChunk("iCCP", "profile\x00\x00zlib"),
+			pngChunk("eXIf", exif),
+			pngChunk("acTL", "\x00\x00\x00\x02\x00\x00\x00\x00"),
+			pngChunk("fcTL", fctl(0)),
+			pngChunk("IDAT", string(pixels)),
+			pngChunk("fcTL", fctl(1)),
+			pngChunk("fdAT", "\x00\x00\x00\x02"+string(pixels)),
+			pngChunk("IEND", ""),
+		}, nil)
+
+		out, upload := stage(in)
+		if upload.Frames != 2 {
+			t.Errorf("frames = %d, want 2", upload.Frames)
+		}
+		a, err := parseAPNG(out, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(a.frames) != 2 {
+			t.Fatalf("%d frames left, want 2", len(a.frames))
+		}
+		for _, frame := range a.frames {
+			img, err := a.decodeFrame(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkUpright(t, img)
+		}
+		if !bytes.Contains(out, []byte("iCCPprofile")) || bytes.Contains(out, []byte("eXIf")) {
+			t.Error("colour profile dropped or EXIF kept")
+		}
+	})
+
+	t.Run("webp", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := nativewebp.Encode(&buf, testPixels(), nil); err != nil {
+			t.Fatal(err)
+		}
+		vp8l := buf.Bytes()[12:]
+		// 3x2, ICC profile and EXIF
+		vp8x := riffChunk("VP8X", "\x28\x00\x00\x00\x02\x00\x00\x01\x00\x00")
+		in := riff(vp8x, riffChunk("ICCP", "profile"), vp8l, riffChunk("EXIF", exif))
+
+		out, _ := stage(in)
+		img, err := webp.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkUpright(t, img)
+		if !bytes.Contains(out, riffChunk("ICCP", "profile")) || bytes.Contains(out, []byte("EXIF")) {
+			t.Error("colour profile dropped or EXIF kept")
+		}
+		if out[20]&0x20 == 0 {
+			t.Error("ICC profile flag not set")
+		}
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+)
+
+// metrics are collected in memory for the life of the process and exposed
+// at /metrics in the Prometheus text format. Like cfg it is shared by the
+// whole package.
+var metrics = NewMetrics()
+
+// Latency buckets in seconds, the Prometheus client defaults.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Metrics struct {
+	uploads         *counterVec
+	uploadBytes     *counterVec
+	uploadFailures  *counterVec
+	served          *counterVec
+	servedBytes     *counterVec
+	gcDuration      *histogramVec
+	gcReclaimed     *counterVec
+	requests        *counterVec
+	requestDuration *histogramVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		uploads:         newCounterVec("goimg_uploads_total", "Images uploaded, by detected type.", "type"),
+		uploadBytes:     newCounterVec("goimg_upload_bytes_total", "Bytes of images uploaded, by detected type.", "type"),
+		uploadFailures:  newCounterVec("goimg_upload_failures_total", "Uploads rejected or failed, by detected type and error code.", "type", "code"),
+		served:          newCounterVec("goimg_served_total", "Images served from /i/, by kind.", "kind"),
+		servedBytes:     newCounterVec("goimg_served_bytes_total", "Bytes of images served from /i/, by kind.", "kind"),
+		gcDuration:      newHistogramVec("goimg_gc_duration_seconds", "Time taken by garbage collection runs.", defaultBuckets),
+		gcReclaimed:     newCounterVec("goimg_gc_reclaimed_total", "Items reclaimed by garbage collection, by kind.", "kind"),
+		requests:        newCounterVec("goimg_http_requests_total", "HTTP requests, by route, method and status code.", "route", "method", "code"),
+		requestDuration: newHistogramVec("goimg_http_request_duration_seconds", "HTTP request latency, by route and method.", defaultBuckets, "route", "method"),
+	}
+}
+
+// Upload records the outcome of an upload of size bytes.
+func (m *Metrics) Upload(fileType string, size int64, err error) {
+	if fileType == "" {
+		fileType = "unknown"
+	}
+	if err != nil {
+		m.uploadFailures.Add(1, fileType, toAPIError(err).Code)
+		return
+	}
+	m.uploads.Add(1, fileType)
+	m.uploadBytes.Add(float64(size), fileType)
+}
+
+// Serve records a response from /i/ for an original, thumbnail or variant.
+func (m *Metrics) Serve(kind string, size int64) {
+	m.served.Add(1, kind)
+	m.servedBytes.Add(float64(size), kind)
+}
+
+// GC records a garbage collection run.
+func (m *Metrics) GC(report *GCReport, took time.Duration) {
+	m.gcDuration.Observe(took.Seconds())
+	m.gcReclaimed.Add(float64(report.Trimmed), "recent")
+	m.gcReclaimed.Add(float64(len(report.Expired)), "expired")
+	m.gcReclaimed.Add(float64(report.Evicted), "evicted")
+	m.gcReclaimed.Add(float64(len(report.Deleted)), "files")
+}
+
+// Instrument wraps h to count and time its requests under route.
+func (m *Metrics) Instrument(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		h(rec, r, params)
+		m.requestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+		m.requests.Add(1, route, r.Method, strconv.Itoa(rec.Status()))
+	}
+}
+
+// WriteTo writes all metrics, along with the size of db and the number of
+// keys in each of its buckets, in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer, db *bolt.DB) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range []*counterVec{m.uploads, m.uploadBytes, m.uploadFailures, m.served, m.servedBytes, m.gcReclaimed, m.requests} {
+		c.writeTo(bw)
+	}
+	for _, h := range []*histogramVec{m.gcDuration, m.requestDuration} {
+		h.writeTo(bw)
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		fmt.Fprintln(bw, "# HELP goimg_bolt_size_bytes Size of the database.")
+		fmt.Fprintln(bw, "# TYPE goimg_bolt_size_bytes gauge")
+		fmt.Fprintf(bw, "goimg_bolt_size_bytes %d\n", tx.Size())
+		fmt.Fprintln(bw, "# HELP goimg_bolt_bucket_keys Keys in each database bucket, including nested buckets.")
+		fmt.Fprintln(bw, "# TYPE goimg_bolt_bucket_keys gauge")
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			fmt.Fprintf(bw, "goimg_bolt_bucket_keys{bucket=\"%s\"} %d\n", escapeLabel(string(name)), b.Stats().KeyN)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Metrics serves the metrics for Prometheus to scrape.
+func (s *Server) Metrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WriteTo(w, s.imageDao.db); err != nil {
+		s.logger.Println("Error writing metrics:", err)
+	}
+}
+
+// responseRecorder remembers the status code and counts the bytes of a
+// response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // by joined label values
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec counts observations into cumulative buckets, partitioned
+// by label values.
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatValue(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// formatLabels renders names with the joined values in key, plus le for
+// histogram buckets unless it is empty.
+func formatLabels(names []string, key string, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", names[i], escapeLabel(value)))
+			}
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
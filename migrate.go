@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/unrolled/logger"
+)
+
+const (
+	META_BUCKET string = "meta"
+	SCHEMA_KEY  string = "schema"
+)
+
+// migration upgrades the database from version-1 to version.
+type migration struct {
+	version     int
+	description string
+	run         func(tx *bolt.Tx) error
+}
+
+// migrations must be kept in order. Never edit a released migration, add a
+// new one instead.
+var migrations = []migration{
+	{1, "store each image as a single JSON record", migrateImageRecords},
+	{2, "index images by owner and uploader cookie", migrateOwnerIndexes},
+}
+
+// SchemaVersion is the database version this build reads and writes.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate creates missing buckets and upgrades the database in place to
+// the current schema version. Each migration runs in its own transaction,
+// so a failure leaves the database at the last good version.
+func Migrate(db *bolt.DB, logger *logger.Logger) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{
+			META_BUCKET, IMAGE_BUCKET, RECENT_BUCKET, EXPIRATION_BUCKET,
+			BLOB_BUCKET, DERIVATIVE_BUCKET, CACHE_BUCKET,
+			OWNER_INDEX_BUCKET, COOKIE_INDEX_BUCKET, QUOTA_BUCKET, TOKEN_BUCKET,
+			LEGACY_COOKIE_BUCKET,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(B(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(B(META_BUCKET)).Get(B(SCHEMA_KEY)); v != nil {
+			current = btoi(v)
+		}
+		return nil
+	})
+	if current > SchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, SchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		logger.Printf("Migrating database to version %d: %s\n", m.version, m.description)
+		err = db.Update(func(tx *bolt.Tx) error {
+			if err := m.run(tx); err != nil {
+				return err
+			}
+			return tx.Bucket(B(META_BUCKET)).Put(B(SCHEMA_KEY), itob(m.version))
+		})
+		if err != nil {
+			return fmt.Errorf("migration to version %d failed: %s", m.version, err)
+		}
+	}
+	return nil
+}
+
+// migrateImageRecords folds the old "UUID:field" keys into one JSON record
+// per image stored under its UUID.
+func migrateImageRecords(tx *bolt.Tx) error {
+	bucket := tx.Bucket(B(IMAGE_BUCKET))
+	fields := make(map[string]map[string][]byte)
+	var oldKeys [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		i := strings.IndexByte(string(k), ':')
+		if i < 0 {
+			return nil
+		}
+		UUID, field := string(k[:i]), string(k[i+1:])
+		if fields[UUID] == nil {
+			fields[UUID] = make(map[string][]byte)
+		}
+		fields[UUID][field] = append([]byte{}, v...)
+		oldKeys = append(oldKeys, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for UUID, f := range fields {
+		unlisted, err := strconv.ParseBool(string(f["unlisted"]))
+		if err != nil {
+			unlisted = true // better safe than sorry
+		}
+		record := imageRecord{
+			Version:   IMAGE_RECORD_VERSION,
+			UUID:      UUID,
+			Path:      string(f["path"]),
+			ThumbPath: string(f["thumbpath"]),
+			Added:     string(f["added"]),
+			Expires:   string(f["expires"]),
+			Delete:    string(f["delete"]),
+			Unlisted:  unlisted,
+			Cookie:    string(f["cookie"]),
+			Owner:     string(f["owner"]),
+			RecentKey: f["recentkey"],
+		}
+		v, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put(B(UUID), v); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range oldKeys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateOwnerIndexes numbers existing images in upload order and adds them
+// to the owner and cookie indexes.
+func migrateOwnerIndexes(tx *bolt.Tx) error {
+	bucket := tx.Bucket(B(IMAGE_BUCKET))
+	var images []*Image
+	err := bucket.ForEach(func(k, v []byte) error {
+		image, err := getImage(bucket, string(k))
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Added < images[j].Added
+	})
+	for _, image := range images {
+		if image.Seq == 0 {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			image.Seq = int(seq)
+			if err = putImage(bucket, image); err != nil {
+				return err
+			}
+		}
+		if err := addToIndexes(tx, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
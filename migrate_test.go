@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/unrolled/logger"
+)
+
+// baselineImages are stored the way goimg did before schema versions, one
+// key per field.
+var baselineImages = []map[string]string{
+	{"uuid": "a", "path": "aaa.png", "thumbpath": "aaa_thumb.png", "added": "2020-01-01T00:00:00Z", "delete": "da", "unlisted": "false", "cookie": "c1", "owner": "alice"},
+	{"uuid": "b", "path": "bbb.jpeg", "thumbpath": "bbb_thumb.jpeg", "added": "2020-01-02T00:00:00Z", "expires": "2030-01-01T00:00:00Z", "delete": "db", "unlisted": "true", "cookie": "c1", "owner": "alice"},
+	{"uuid": "c", "path": "ccc.gif", "thumbpath": "ccc_thumb.gif", "added": "2020-01-03T00:00:00Z", "delete": "dc", "unlisted": "maybe", "cookie": "c2"},
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "goimg.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		images, _ := tx.CreateBucket(B(IMAGE_BUCKET))
+		recent, _ := tx.CreateBucket(B(RECENT_BUCKET))
+		expiration, _ := tx.CreateBucket(B(EXPIRATION_BUCKET))
+		for _, image := range baselineImages {
+			UUID := image["uuid"]
+			for _, field := range []string{"path", "thumbpath", "added", "expires", "delete", "unlisted", "cookie", "owner"} {
+				images.Put(B(UUID+":"+field), B(image[field]))
+			}
+			if image["unlisted"] == "false" {
+				seq, _ := recent.NextSequence()
+				recent.Put(itob(int(seq)), B(UUID))
+				images.Put(B(UUID+":recentkey"), itob(int(seq)))
+			} else {
+				images.Put(B(UUID+":recentkey"), nil)
+			}
+			if image["expires"] != "" {
+				expiration.Put(B(image["expires"]), B(UUID))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New(logger.Options{Out: ioutil.Discard})
+	if err = Migrate(db, log); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again changes nothing.
+	if err = Migrate(db, log); err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(B(META_BUCKET)).Get(B(SCHEMA_KEY)); v == nil || btoi(v) != SchemaVersion() {
+			t.Errorf("schema key = %v, want %d", v, SchemaVersion())
+		}
+		return tx.Bucket(B(IMAGE_BUCKET)).ForEach(func(k, v []byte) error {
+			if strings.Contains(string(k), ":") {
+				t.Errorf("old field key left behind: %s", k)
+			}
+			return nil
+		})
+	})
+
+	dao := NewImageDao(db, log)
+	var seqs []int
+	for _, want := range baselineImages {
+		image, err := dao.Load(want["uuid"])
+		if err != nil || image == nil {
+			t.Fatalf("image %s not loaded: %v", want["uuid"], err)
+		}
+		if image.path != want["path"] || image.thumbPath != want["thumbpath"] || image.Added != want["added"] ||
+			image.Expires != want["expires"] || image.Delete != want["delete"] || image.cookie != want["cookie"] || image.Owner != want["owner"] {
+			t.Errorf("image %s migrated as %+v", want["uuid"], image)
+		}
+		if image.Unlisted != (want["unlisted"] != "false") {
+			t.Errorf("image %s unlisted = %v", want["uuid"], image.Unlisted)
+		}
+		if (image.RecentKey != nil) != (want["unlisted"] == "false") {
+			t.Errorf("image %s recent key = %v", want["uuid"], image.RecentKey)
+		}
+		seqs = append(seqs, image.Seq)
+	}
+	if !(seqs[0] > 0 && seqs[0] < seqs[1] && seqs[1] < seqs[2]) {
+		t.Errorf("images numbered %v, want upload order", seqs)
+	}
+
+	if images, _ := dao.ListByOwner("alice", 0, 10); len(images) != 1 || images[0].UUID != "a" {
+		t.Errorf("owner index lists %v, want the listed image a", uuids(images))
+	}
+	if images, _ := dao.ListByCookie("c1", 0, 10); len(images) != 2 || images[0].UUID != "b" || images[1].UUID != "a" {
+		t.Errorf("cookie index lists %v, want b, a", uuids(images))
+	}
+}
+
+func uuids(images []*Image) []string {
+	var UUIDs []string
+	for _, image := range images {
+		UUIDs = append(UUIDs, image.UUID)
+	}
+	return UUIDs
+}
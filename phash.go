@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Every upload gets a perceptual hash of its thumbnail, a difference hash
+// (dHash): the thumbnail is shrunk to 9x8 grey pixels and each bit records
+// whether a pixel is darker than its right neighbour. Re-encoding, resizing
+// and small edits flip few bits, so images that look alike have hashes a
+// small Hamming distance apart. The hashes are kept in the image records
+// and indexed in a BK-tree in memory, built when the server starts.
+
+const (
+	DUPLICATES_ALLOW    string = "allow"    // save near-duplicates without a word
+	DUPLICATES_WARN     string = "warn"     // save them and point out the similar images
+	DUPLICATES_REDIRECT string = "redirect" // send the uploader to the earlier image instead
+)
+
+// DuplicateError rejects an upload that looks like the image UUID.
+type DuplicateError struct {
+	UUID string
+}
+
+func (e *DuplicateError) Error() string {
+	return "A similar image was already uploaded: " + e.UUID
+}
+
+// dHash returns the difference hash of img.
+func dHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x*4] < row[(x+1)*4] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashImage decodes the thumbnail in r and returns its hash in hex.
+func hashImage(r io.Reader) (string, error) {
+	img, err := imaging.Decode(r)
+	if err != nil {
+		return "", ErrDecode
+	}
+	return fmt.Sprintf("%016x", dHash(img)), nil
+}
+
+// hashThumbnail sets the hash of the upload from its staged or stored
+// thumbnail. An image that can't be hashed is still accepted, it just
+// won't turn up as similar to anything.
+func (u *Upload) hashThumbnail() {
+	var r io.ReadCloser
+	var err error
+	if u.thumbTmp != "" {
+		r, err = os.Open(u.thumbTmp)
+	} else {
+		r, err = u.fs.storage.Get(u.ThumbKey)
+	}
+	if err == nil {
+		u.Hash, err = hashImage(r)
+		r.Close()
+	}
+	if err != nil {
+		u.fs.logger.Printf("Error hashing %s: %s\n", u.ThumbKey, err)
+	}
+}
+
+// HashImage returns the hash of the thumbnail of image, rendering the
+// thumbnail first if it is missing.
+func (fs *FS) HashImage(image *Image) (string, error) {
+	if err := fs.Thumbnail(image); err != nil {
+		return "", err
+	}
+	r, err := fs.storage.Get(image.thumbPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashImage(r)
+}
+
+// SimilarIndex finds images by hash distance. Nodes of the BK-tree hold
+// every image with one hash, and each child sits at its distance from the
+// parent, so a search only descends into children within reach.
+// Images are added once their record is saved, and deleted images are
+// left in place until a search finds their record gone and drops them.
+// In redirect mode uploads reserve their place before they are saved, and
+// are pending until they settle or are removed.
+type SimilarIndex struct {
+	mu      sync.RWMutex
+	root    *bkNode
+	pending map[string]bool
+
+	// uploads is held in redirect mode while an upload is checked for
+	// near-duplicates and reserved, so two alike uploads can't both pass
+	// the check.
+	uploads sync.Mutex
+}
+
+type bkNode struct {
+	hash     uint64
+	uuids    []string
+	children map[int]*bkNode
+}
+
+// similarMatch is an image found by a search, with its distance.
+type similarMatch struct {
+	UUID     string
+	Distance int
+}
+
+// NewSimilarIndex indexes the hashes of every stored image.
+func NewSimilarIndex(dao *ImageDao) (*SimilarIndex, error) {
+	idx := &SimilarIndex{pending: make(map[string]bool)}
+	err := dao.ForEach(func(image *Image) error {
+		idx.Add(image.Hash, image.UUID)
+		return nil
+	})
+	return idx, err
+}
+
+func parseHash(hash string) (uint64, bool) {
+	h, err := strconv.ParseUint(hash, 16, 64)
+	return h, err == nil && hash != ""
+}
+
+// Add indexes the image UUID under hash. Images without one are ignored.
+func (idx *SimilarIndex) Add(hash string, UUID string) {
+	h, ok := parseHash(hash)
+	if !ok {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.root == nil {
+		idx.root = &bkNode{hash: h, uuids: []string{UUID}}
+		return
+	}
+	node := idx.root
+	for {
+		d := bits.OnesCount64(node.hash ^ h)
+		if d == 0 {
+			node.uuids = append(node.uuids, UUID)
+			return
+		}
+		child, ok := node.children[d]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[d] = &bkNode{hash: h, uuids: []string{UUID}}
+			return
+		}
+		node = child
+	}
+}
+
+// Reserve indexes the image UUID under hash while its upload is saved.
+// Searches find it, but it is pending until Settle or Remove.
+func (idx *SimilarIndex) Reserve(hash string, UUID string) {
+	if _, ok := parseHash(hash); !ok {
+		return
+	}
+	idx.Add(hash, UUID)
+	idx.mu.Lock()
+	idx.pending[UUID] = true
+	idx.mu.Unlock()
+}
+
+// Settle marks the reserved image UUID saved.
+func (idx *SimilarIndex) Settle(UUID string) {
+	idx.mu.Lock()
+	delete(idx.pending, UUID)
+	idx.mu.Unlock()
+}
+
+// Pending reports whether the image UUID is reserved by an upload that
+// hasn't been saved yet.
+func (idx *SimilarIndex) Pending(UUID string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.pending[UUID]
+}
+
+// Remove drops the image UUID from under hash. The node stays, children
+// are found through it.
+func (idx *SimilarIndex) Remove(hash string, UUID string) {
+	h, ok := parseHash(hash)
+	if !ok {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.pending, UUID)
+
+	node := idx.root
+	for node != nil && node.hash != h {
+		node = node.children[bits.OnesCount64(node.hash^h)]
+	}
+	if node == nil {
+		return
+	}
+	for i, indexed := range node.uuids {
+		if indexed == UUID {
+			node.uuids = append(node.uuids[:i:i], node.uuids[i+1:]...)
+			return
+		}
+	}
+}
+
+// Find returns the images whose hash is at most max bits from hash,
+// closest first.
+func (idx *SimilarIndex) Find(hash string, max int) []similarMatch {
+	h, ok := parseHash(hash)
+	if !ok {
+		return nil
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var matches []similarMatch
+	var stack []*bkNode
+	if idx.root != nil {
+		stack = append(stack, idx.root)
+	}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := bits.OnesCount64(node.hash ^ h)
+		if d <= max {
+			for _, UUID := range node.uuids {
+				matches = append(matches, similarMatch{UUID, d})
+			}
+		}
+		for k := d - max; k <= d+max; k++ {
+			if child, ok := node.children[k]; ok {
+				stack = append(stack, child)
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Distance < matches[j].Distance
+	})
+	return matches
+}
+
+// similarImages returns up to a page of images that look like the image
+// with hash, closest first. It leaves out exclude, uploads still being
+// saved and the unlisted images of anyone but the requester.
+func (s *Server) similarImages(r *http.Request, hash string, exclude string) []*Image {
+	cookie := r.Context().Value(AppCookie).(string)
+	var images []*Image
+	for _, match := range s.similar.Find(hash, s.config.similarDistance) {
+		// A pending upload's record may not be saved yet, it mustn't be
+		// taken for deleted.
+		if match.UUID == exclude || s.similar.Pending(match.UUID) {
+			continue
+		}
+		image, err := s.imageDao.Load(match.UUID)
+		if err != nil {
+			s.logger.Println(err)
+			continue
+		}
+		if image == nil {
+			s.similar.Remove(hash, match.UUID)
+			continue
+		}
+		if image.Unlisted && image.cookie != cookie {
+			continue
+		}
+		images = append(images, image)
+		if len(images) == GALLERY_PAGE_SIZE {
+			break
+		}
+	}
+	return images
+}
+
+// reserveUpload turns away an upload that looks like an earlier image, or
+// like one still being saved, and otherwise reserves its hash under UUID
+// so alike uploads that follow are turned away too. It is only used in
+// redirect mode.
+func (s *Server) reserveUpload(r *http.Request, hash string, UUID string) error {
+	s.similar.uploads.Lock()
+	defer s.similar.uploads.Unlock()
+	for _, match := range s.similar.Find(hash, s.config.similarDistance) {
+		if s.similar.Pending(match.UUID) {
+			// Its owner may not want it shown, so don't point to it.
+			return &APIError{http.StatusConflict, "upload_in_progress", "A similar image is being uploaded, try again shortly"}
+		}
+	}
+	if similar := s.similarImages(r, hash, ""); len(similar) > 0 {
+		return &DuplicateError{similar[0].UUID}
+	}
+	s.similar.Reserve(hash, UUID)
+	return nil
+}
+
+// nearDuplicates returns the UUIDs of images that look like a new upload,
+// if the server warns about them.
+func (s *Server) nearDuplicates(r *http.Request, image *Image) []string {
+	if s.config.duplicates != DUPLICATES_WARN {
+		return nil
+	}
+	var UUIDs []string
+	for _, similar := range s.similarImages(r, image.Hash, image.UUID) {
+		UUIDs = append(UUIDs, similar.UUID)
+	}
+	return UUIDs
+}
+
+// ViewSimilar lists the images that look like the image UUID.
+func (s *Server) ViewSimilar(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image, err := s.imageDao.Load(params.ByName("UUID"))
+	if err != nil || image == nil {
+		s.NotFound(w, nil, nil)
+		return
+	}
+	s.render("gallery", w, galleryPage("Similar images", s.similarImages(r, image.Hash, image.UUID), 0))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func newTestIndex(t *testing.T) *SimilarIndex {
+	idx, err := NewSimilarIndex(newTestDao(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestSimilarIndexFind(t *testing.T) {
+	idx := newTestIndex(t)
+	for _, image := range []struct{ hash, UUID string }{
+		{"0000000000000000", "zero"},
+		{"0000000000000001", "one bit"},
+		{"0000000000000001", "one bit again"},
+		{"00000000000000ff", "eight bits"},
+		{"ffffffffffffffff", "all bits"},
+		{"", "unhashed"},
+		{"not hex", "bad hash"},
+	} {
+		idx.Add(image.hash, image.UUID)
+	}
+
+	tests := []struct {
+		hash string
+		max  int
+		want []similarMatch
+	}{
+		{"0000000000000000", 0, []similarMatch{{"zero", 0}}},
+		{"0000000000000000", 1, []similarMatch{{"zero", 0}, {"one bit", 1}, {"one bit again", 1}}},
+		{"0000000000000000", 8, []similarMatch{{"zero", 0}, {"one bit", 1}, {"one bit again", 1}, {"eight bits", 8}}},
+		{"00000000000000fe", 1, []similarMatch{{"eight bits", 1}}},
+		{"fffffffffffffff0", 4, []similarMatch{{"all bits", 4}}},
+		{"0f0f0f0f0f0f0f0f", 3, nil},
+		{"", 64, nil},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s within %d", test.hash, test.max), func(t *testing.T) {
+			got := idx.Find(test.hash, test.max)
+			sortMatches(got)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("Find = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	idx.Remove("0000000000000001", "one bit")
+	idx.Remove("0000000000000001", "not indexed")
+	idx.Remove("1234000000000000", "no such hash")
+	got := idx.Find("0000000000000000", 1)
+	sortMatches(got)
+	if want := []similarMatch{{"zero", 0}, {"one bit again", 1}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after Remove, Find = %v, want %v", got, want)
+	}
+}
+
+// TestSimilarIndexMatchesScan checks the tree against comparing every
+// hash, for random hashes clustered enough to be found.
+func TestSimilarIndexMatchesScan(t *testing.T) {
+	idx := newTestIndex(t)
+	rng := rand.New(rand.NewSource(1))
+	base := rng.Uint64()
+	hashes := make(map[string]uint64)
+	for i := 0; i < 2000; i++ {
+		h := base
+		for flips := rng.Intn(24); flips > 0; flips-- {
+			h ^= 1 << uint(rng.Intn(64))
+		}
+		UUID := fmt.Sprint(i)
+		hashes[UUID] = h
+		idx.Add(fmt.Sprintf("%016x", h), UUID)
+	}
+
+	for i := 0; i < 50; i++ {
+		query := base ^ 1<<uint(rng.Intn(64)) ^ 1<<uint(rng.Intn(64))
+		max := rng.Intn(12)
+		var want []similarMatch
+		for UUID, h := range hashes {
+			if d := bits.OnesCount64(h ^ query); d <= max {
+				want = append(want, similarMatch{UUID, d})
+			}
+		}
+		got := idx.Find(fmt.Sprintf("%016x", query), max)
+		for i := 1; i < len(got); i++ {
+			if got[i].Distance < got[i-1].Distance {
+				t.Fatalf("matches not closest first: %v", got)
+			}
+		}
+		sortMatches(got)
+		sortMatches(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Find %016x within %d found %d images, a scan %d", query, max, len(got), len(want))
+		}
+	}
+}
+
+func TestSimilarIndexReserve(t *testing.T) {
+	idx := newTestIndex(t)
+	idx.Reserve("00000000000000ff", "uploading")
+	idx.Reserve("", "unhashed")
+	if !idx.Pending("uploading") || idx.Pending("unhashed") {
+		t.Fatal("reservation not pending")
+	}
+	if got := idx.Find("00000000000000ff", 0); len(got) != 1 || got[0].UUID != "uploading" {
+		t.Fatalf("reserved image not found: %v", got)
+	}
+
+	idx.Settle("uploading")
+	if idx.Pending("uploading") || len(idx.Find("00000000000000ff", 0)) != 1 {
+		t.Error("settled image pending or gone")
+	}
+
+	idx.Reserve("00000000000000ff", "failed")
+	idx.Remove("00000000000000ff", "failed")
+	if idx.Pending("failed") || len(idx.Find("00000000000000ff", 0)) != 1 {
+		t.Error("failed upload left in the index")
+	}
+}
+
+func sortMatches(matches []similarMatch) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].UUID < matches[j].UUID
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3UnsignedPayload string = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      string = "20060102T150405Z"
+)
+
+// S3Storage keeps objects in an S3-compatible object store (AWS S3, MinIO,
+// Ceph RGW, ...). Requests are signed with AWS Signature Version 4.
+type S3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	prefix    string // Prepended to every key
+	client    *http.Client
+}
+
+func NewS3Storage(cfg Config) (*S3Storage, error) {
+	if cfg.s3Endpoint == "" || cfg.s3Bucket == "" {
+		return nil, errors.New("s3 storage requires an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(cfg.s3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", cfg.s3Endpoint)
+	}
+	region := cfg.s3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	prefix := strings.TrimPrefix(cfg.s3Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Storage{
+		endpoint:  endpoint,
+		bucket:    cfg.s3Bucket,
+		region:    region,
+		accessKey: cfg.s3AccessKey,
+		secretKey: cfg.s3SecretKey,
+		pathStyle: cfg.s3PathStyle,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s3 *S3Storage) Put(key string, r io.Reader) error {
+	body, length, err := sized(r)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s3.do(http.MethodPut, key, body, length, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s3 *S3Storage) Get(key string) (io.ReadCloser, error) {
+	resp, err := s3.do(http.MethodGet, key, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s3 *S3Storage) Stat(key string) (*StorageInfo, error) {
+	resp, err := s3.do(http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &StorageInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s3 *S3Storage) Delete(key string) error {
+	resp, err := s3.do(http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stream proxies the object to w, passing conditional and range headers
+// through to the object store.
+func (s3 *S3Storage) Stream(w http.ResponseWriter, r *http.Request, key string) error {
+	header := http.Header{}
+	for _, name := range []string{"Range", "If-None-Match", "If-Modified-Since"} {
+		if value := r.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	resp, err := s3.do(http.MethodGet, key, nil, 0, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		io.Copy(w, resp.Body)
+	}
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response we use.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through the keys under the prefix with ListObjectsV2.
+func (s3 *S3Storage) List(fn func(key string, info *StorageInfo) error) error {
+	var token string
+	for {
+		u := s3.bucketURL()
+		query := url.Values{"list-type": {"2"}}
+		if s3.prefix != "" {
+			query.Set("prefix", s3.prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(query)
+
+		resp, err := s3.send(http.MethodGet, u, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list %s: %s", s3.bucket, err)
+		}
+
+		for _, object := range result.Contents {
+			if err = fn(strings.TrimPrefix(object.Key, s3.prefix), &StorageInfo{Size: object.Size, ModTime: object.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for key. Error statuses are turned into errors;
+// 404 is reported as os.ErrNotExist.
+func (s3 *S3Storage) do(method string, key string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	return s3.send(method, s3.objectURL(key), body, length, header)
+}
+
+func (s3 *S3Storage) send(method string, u *url.URL, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	s3.sign(req, time.Now().UTC())
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: path.Base(u.Path), Err: os.ErrNotExist}
+	case resp.StatusCode == http.StatusNotModified:
+		return resp, nil
+	case resp.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// bucketURL returns the URL of the bucket using path-style (endpoint/bucket/)
+// or virtual-hosted (bucket.endpoint/) addressing.
+func (s3 *S3Storage) bucketURL() *url.URL {
+	u := *s3.endpoint
+	if s3.pathStyle {
+		u.Path = "/" + s3.bucket + "/"
+	} else {
+		u.Host = s3.bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return &u
+}
+
+// objectURL returns the URL for key under the prefix. Like DiskStorage,
+// only the base name of key is used.
+func (s3 *S3Storage) objectURL(key string) *url.URL {
+	u := s3.bucketURL()
+	u.Path += s3.prefix + path.Base(key)
+	return u
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+// See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s3 *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signed := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s3.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s3.secretKey), date)
+	key = hmacSHA256(key, s3.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// canonicalQuery encodes query the way Signature Version 4 expects:
+// sorted by name and value, with spaces as %20 where url.Values.Encode
+// would write +.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape escapes everything but the unreserved characters A-Z, a-z,
+// 0-9, '-', '.', '_' and '~'.
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sized returns a reader for r along with its length, which S3 requires up
+// front. Readers of unknown length are buffered in memory.
+func sized(r io.Reader) (io.Reader, int64, error) {
+	switch v := r.(type) {
+	case *bytes.Reader:
+		return v, int64(v.Len()), nil
+	case *bytes.Buffer:
+		return v, int64(v.Len()), nil
+	case *os.File:
+		finfo, err := v.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+		return v, finfo.Size() - offset, nil
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(buf), int64(len(buf)), nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey string = "AKIDEXAMPLE"
+	testSecretKey string = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testBucket    string = "goimg"
+)
+
+// fakeS3 is an in-memory stand-in for a path-style S3 bucket. It checks
+// the signature of every request and lists one object per page, with
+// continuation tokens that need escaping.
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte
+	modTime time.Time
+	forged  bool // Bad signatures are expected rather than test failures
+	url     string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Storage) {
+	fake := &fakeS3{t: t, objects: make(map[string][]byte), modTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	fake.url = srv.URL
+	return fake, fake.storage("")
+}
+
+// storage returns a client for the fake bucket that keeps its keys under
+// prefix.
+func (f *fakeS3) storage(prefix string) *S3Storage {
+	s3, err := NewS3Storage(Config{
+		s3Endpoint:  f.url,
+		s3Bucket:    testBucket,
+		s3AccessKey: testAccessKey,
+		s3SecretKey: testSecretKey,
+		s3PathStyle: true,
+		s3Prefix:    prefix,
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return s3
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.verify(r); err != nil {
+		if !f.forged {
+			f.t.Errorf("%s %s: %s", r.Method, r.URL, err)
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	prefix := "/" + testBucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.ContentLength != int64(len(data)) {
+			f.t.Errorf("PUT %s: Content-Length %d for %d bytes", key, r.ContentLength, len(data))
+		}
+		f.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", f.modTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers ListObjectsV2 one key at a time. The token is the key to
+// start from, behind a space and a plus sign.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("list-type") != "2" {
+		http.Error(w, "expected list-type=2", http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := r.URL.Query().Get("continuation-token"); token != "" {
+		after := strings.TrimPrefix(token, "next +")
+		start = sort.SearchStrings(keys, after)
+	}
+	type object struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if start < len(keys) {
+		result.Contents = append(result.Contents, object{keys[start], len(f.objects[keys[start]]), f.modTime})
+	}
+	if start+1 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = "next +" + keys[start+1]
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verify recomputes the Signature Version 4 signature from the request as
+// received, taking the query as sent rather than decoding it.
+func (f *fakeS3) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return fmt.Errorf("unexpected Authorization %q", auth)
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		if i := strings.Index(field, "="); i > 0 {
+			fields[field[:i]] = field[i+1:]
+		}
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != testAccessKey || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return fmt.Errorf("unexpected Credential %q", fields["Credential"])
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, credential[1]) {
+		return fmt.Errorf("X-Amz-Date %q doesn't match the credential date %q", amzDate, credential[1])
+	}
+	if strings.Contains(r.URL.RawQuery, "+") {
+		return fmt.Errorf("query %q has a + rather than %%20 or %%2B", r.URL.RawQuery)
+	}
+	query := strings.Split(r.URL.RawQuery, "&")
+	sort.Strings(query)
+
+	var headers strings.Builder
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(query, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join(credential[1:], "/")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range credential[1:] {
+		key = hmacSHA256(key, part)
+	}
+	if signature := hex.EncodeToString(hmacSHA256(key, stringToSign)); signature != fields["Signature"] {
+		return fmt.Errorf("signature %s, expected %s", fields["Signature"], signature)
+	}
+	return nil
+}
+
+func TestS3Storage(t *testing.T) {
+	fake, s3 := newFakeS3(t)
+
+	for _, key := range []string{"a.png", "b.png", "c_thumb.png"} {
+		if err := s3.Put(key, strings.NewReader("data of "+key)); err != nil {
+			t.Fatalf("Put %s: %s", key, err)
+		}
+	}
+
+	r, err := s3.Get("b.png")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "data of b.png" {
+		t.Errorf("Get returned %q", data)
+	}
+
+	info, err := s3.Stat("b.png")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Size != int64(len("data of b.png")) || !info.ModTime.Equal(fake.modTime) {
+		t.Errorf("Stat returned %+v", info)
+	}
+
+	listed := make(map[string]int64)
+	err = s3.List(func(key string, info *StorageInfo) error {
+		listed[key] = info.Size
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if len(listed) != 3 || listed["c_thumb.png"] != int64(len("data of c_thumb.png")) {
+		t.Errorf("List returned %v", listed)
+	}
+
+	if err = s3.Delete("a.png"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err = s3.Get("a.png"); !os.IsNotExist(err) {
+		t.Errorf("Get after Delete returned %v, expected a not-exist error", err)
+	}
+	if _, err = s3.Stat("a.png"); !os.IsNotExist(err) {
+		t.Errorf("Stat after Delete returned %v, expected a not-exist error", err)
+	}
+}
+
+func TestS3StoragePrefix(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	a, b := fake.storage("a"), fake.storage("/b/")
+	for _, s3 := range []*S3Storage{a, b} {
+		if err := s3.Put("x.png", strings.NewReader("data")); err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+	}
+	if _, ok := fake.objects["a/x.png"]; !ok || len(fake.objects) != 2 {
+		t.Fatalf("expected a/x.png and b/x.png, bucket holds %v", fake.objects)
+	}
+
+	if err := a.Delete("x.png"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := b.Stat("x.png"); err != nil {
+		t.Errorf("Deleting a/x.png removed b/x.png: %s", err)
+	}
+	var listed []string
+	b.List(func(key string, info *StorageInfo) error {
+		listed = append(listed, key)
+		return nil
+	})
+	if len(listed) != 1 || listed[0] != "x.png" {
+		t.Errorf("List under b/ returned %v", listed)
+	}
+}
+
+func TestS3StorageBadSignature(t *testing.T) {
+	fake, s3 := newFakeS3(t)
+	fake.forged = true
+	s3.secretKey = "wrong"
+	if err := s3.Put("a.png", strings.NewReader("data")); err == nil {
+		t.Error("Put signed with the wrong key succeeded")
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	query := url.Values{
+		"list-type":          {"2"},
+		"continuation-token": {"a b+c/d=~"},
+		"a":                  {"2", "1"},
+		"a-b":                {"x"},
+	}
+	expected := "a=1&a=2&a-b=x&continuation-token=a%20b%2Bc%2Fd%3D~&list-type=2"
+	if got := canonicalQuery(query); got != expected {
+		t.Errorf("canonicalQuery returned %s, expected %s", got, expected)
+	}
+}
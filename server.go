@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	"github.com/unrolled/logger"
 
@@ -18,6 +21,8 @@ import (
 
 var (
 	maxUploadSize int64  = 10 * 1024 * 1024 // 2 mb
+	maxFieldSize  int64  = 1024             // non-file form values
+	maxPatchSize  int64  = 64 * 1024        // JSON bodies of API updates
 	AppCookie     string = "goimg"
 )
 
@@ -27,6 +32,11 @@ type Page struct {
 	Images []string
 	Image  *Image
 	Owned  bool
+	Next   int  // Cursor for the next page of Images, 0 if none
+	Mine   bool // Listing the requester's own uploads
+
+	Animated map[string]bool // Which of Images are animated
+	Notice   string          // Shown above the image after an upload
 }
 
 // Server ...
@@ -34,33 +44,36 @@ type Server struct {
 	config    Config
 	templates *Templates
 	router    *httprouter.Router
+	http      *http.Server
 
 	imageDao *ImageDao
 	fs       *FS
+	gc       *GC // checked by /readyz
+	limiter  *RateLimiter
+	signer   *CookieSigner
+	similar  *SimilarIndex
+	proxies  TrustedProxies // whose X-Forwarded-For is believed
 
 	// Logger
 	logger *logger.Logger
-
-	// Stats/Metrics
-	// counters *Counters
-	// stats    *stats.Stats
 }
 
 // NewServer ...
-func NewServer(imageDao *ImageDao, fs *FS, config Config, logger *logger.Logger) *Server {
+func NewServer(imageDao *ImageDao, fs *FS, gc *GC, signer *CookieSigner, similar *SimilarIndex, proxies TrustedProxies, config Config, logger *logger.Logger) *Server {
 	server := &Server{
 		config:    config,
 		router:    httprouter.New(),
 		templates: NewTemplates("base"),
 		imageDao:  imageDao,
 		fs:        fs,
+		gc:        gc,
+		limiter:   NewRateLimiter(config.uploadRate, config.uploadBurst),
+		signer:    signer,
+		similar:   similar,
+		proxies:   proxies,
 
 		// Logger
 		logger: logger,
-
-		// Stats/Metrics
-		// counters: NewCounters(),
-		// stats:    stats.New(),
 	}
 
 	// Templates
@@ -82,6 +95,10 @@ func NewServer(imageDao *ImageDao, fs *FS, config Config, logger *logger.Logger)
 	template.Must(notFoundTemplate.Parse(box.MustString("404.html")))
 	template.Must(notFoundTemplate.Parse(box.MustString("base.html")))
 
+	galleryTemplate := template.New("gallery")
+	template.Must(galleryTemplate.Parse(box.MustString("gallery.html")))
+	template.Must(galleryTemplate.Parse(box.MustString("base.html")))
+
 	recentTemplate := template.New("recent")
 	template.Must(recentTemplate.Parse(box.MustString("recent.html")))
 	template.Must(recentTemplate.Parse(box.MustString("base.html")))
@@ -91,6 +108,7 @@ func NewServer(imageDao *ImageDao, fs *FS, config Config, logger *logger.Logger)
 	server.templates.Add("about", aboutTemplate)
 	server.templates.Add("notfound", notFoundTemplate)
 	server.templates.Add("recent", recentTemplate)
+	server.templates.Add("gallery", galleryTemplate)
 
 	server.initRoutes()
 
@@ -102,12 +120,57 @@ func (s *Server) Index(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 }
 
 func (s *Server) ViewRecent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	images, next := s.imageDao.ListRecent(pageCursor(r), cfg.recentPageSize)
 	data := &Page{
-		Images: s.imageDao.ListRecent(),
+		Title:    "Recent",
+		Images:   images,
+		Next:     next,
+		Animated: s.imageDao.Animated(images),
 	}
 	s.render("recent", w, data)
 }
 
+// ViewMine lists every image uploaded with the requester's cookie,
+// including unlisted ones.
+func (s *Server) ViewMine(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	cookie := r.Context().Value(AppCookie).(string)
+	images, next := s.imageDao.ListByCookie(cookie, pageCursor(r), GALLERY_PAGE_SIZE)
+	page := galleryPage("My images", images, next)
+	page.Mine = true
+	s.render("gallery", w, page)
+}
+
+// ViewOwner lists the listed images uploaded under an owner name.
+func (s *Server) ViewOwner(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	owner := params.ByName("owner")
+	images, next := s.imageDao.ListByOwner(owner, pageCursor(r), GALLERY_PAGE_SIZE)
+	s.render("gallery", w, galleryPage("Uploaded by "+owner, images, next))
+}
+
+func galleryPage(title string, images []*Image, next int) *Page {
+	page := &Page{
+		Title:    title,
+		Next:     next,
+		Animated: make(map[string]bool),
+	}
+	for _, image := range images {
+		page.Images = append(page.Images, image.UUID)
+		if image.Frames > 1 {
+			page.Animated[image.UUID] = true
+		}
+	}
+	return page
+}
+
+// pageCursor reads the "before" paging cursor from the query string.
+func pageCursor(r *http.Request) int {
+	before, err := strconv.Atoi(r.URL.Query().Get("before"))
+	if err != nil || before < 0 {
+		return 0
+	}
+	return before
+}
+
 func (s *Server) About(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	s.render("about", w, nil)
 }
@@ -118,43 +181,178 @@ func (s *Server) NotFound(w http.ResponseWriter, _ *http.Request, _ httprouter.P
 }
 
 func (s *Server) Upload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	image, err := s.saveUpload(w, r)
+	var duplicate *DuplicateError
+	if errors.As(err, &duplicate) && !wantsJSON(r) {
+		http.Redirect(w, r, fmt.Sprintf("/view/%s?duplicate=true", duplicate.UUID), http.StatusFound)
+		return
+	}
+	if err != nil {
+		apiErr := toAPIError(err)
+		if wantsJSON(r) {
+			s.writeError(w, apiErr)
+		} else {
+			http.Error(w, apiErr.Message, apiErr.Status)
+		}
+		return
+	}
+
+	similar := s.nearDuplicates(r, image)
+	if wantsJSON(r) {
+		doc := s.imageDoc(r, image, true)
+		doc.Similar = similar
+		s.writeJSON(w, http.StatusCreated, doc)
+		return
+	}
+
+	// done
+	if len(similar) > 0 {
+		http.Redirect(w, r, fmt.Sprintf("/view/%s?similar=%d", image.UUID, len(similar)), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/view/%s", image.UUID), http.StatusFound)
+}
+
+// saveUpload stores the file posted in r and records the new image. It is
+// shared by the HTML form and the JSON API. The multipart body is read part
+// by part so the file is streamed to a staging file rather than buffered.
+//
+// Uploads are all-or-nothing: the file and thumbnail are staged under
+// temporary names, the database record is written, and only then are the
+// files moved into storage. A failure at any step undoes the previous ones.
+func (s *Server) saveUpload(w http.ResponseWriter, r *http.Request) (image *Image, err error) {
+	var upload *Upload
+	defer func() {
+		if upload != nil {
+			metrics.Upload(upload.Type, upload.Size, err)
+		} else {
+			metrics.Upload("", 0, err)
+		}
+	}()
+
 	id, _ := shortid.Generate()
 	deleteKey, _ := shortid.Generate()
 	cookie := r.Context().Value(AppCookie).(string)
 
+	token, apiErr := s.bearerToken(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if token != nil && !token.Has(SCOPE_UPLOAD) {
+		return nil, errTokenScope
+	}
+	clients, limit := uploadClients(r, token, s.proxies)
+	if err = s.limitUploads(w, token, clients, limit); err != nil {
+		return nil, err
+	}
+
 	// validate file size
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+	reader, err := r.MultipartReader()
+	if err != nil {
 		s.logger.Println(err)
-		return
+		return nil, &APIError{http.StatusBadRequest, "invalid_form", "Upload must be a multipart form"}
 	}
 
 	// parse and validate file and post parameters
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		s.logger.Println(err)
-		return
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if upload != nil {
+				upload.Cleanup()
+			}
+			s.logger.Println(err)
+			return nil, uploadError(err)
+		}
+
+		name := part.FormName()
+		if name == "file" && upload == nil {
+			// Stage file and thumbnail
+			upload, err = s.fs.Stage(part)
+			if err != nil {
+				part.Close()
+				s.logger.Println(err)
+				return nil, uploadError(err)
+			}
+		} else if name != "" && name != "file" {
+			value, _ := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+			fields[name] = string(value)
+		}
+		part.Close()
 	}
-	defer file.Close()
 
-	// Save to disk
-	newPath, thumbPath := s.fs.Save(file, id)
+	if upload == nil {
+		return nil, &APIError{http.StatusBadRequest, "missing_file", "No file was uploaded"}
+	}
+	defer upload.Cleanup()
 
-	if newPath == "" && thumbPath == "" {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+	redirect := s.config.duplicates == DUPLICATES_REDIRECT
+	if redirect {
+		if err = s.reserveUpload(r, upload.Hash, id); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				s.similar.Remove(upload.Hash, id)
+			} else {
+				s.similar.Settle(id)
+			}
+		}()
 	}
 
-	image := NewImage(r.FormValue("owner"), id, newPath, thumbPath, r.FormValue("private") != "", r.FormValue("expire"), deleteKey, cookie)
+	refund, err := s.chargeQuota(w, clients, limit, upload.Size)
+	if err != nil {
+		return nil, err
+	}
 
-	s.imageDao.Save(image)
+	image = NewImage(fields["owner"], id, upload.Key, upload.ThumbKey, fields["private"] != "", fields["expire"], deleteKey, cookie)
+	if token != nil {
+		image.Token = token.Name
+	}
+	image.Metadata = upload.Metadata
+	image.Frames, image.Duration = upload.Frames, upload.Duration
+	image.Hash = upload.Hash
+
+	if err = s.imageDao.Save(image); err != nil {
+		s.logger.Println("Error saving image record:", err)
+		refund()
+		return nil, &APIError{http.StatusInternalServerError, "save_failed", "Could not save image record"}
+	}
 
-	if err != nil {
-		return
+	if err = upload.Commit(); err != nil {
+		s.logger.Println("Error storing image:", err)
+		if _, derr := s.imageDao.Delete(image); derr != nil {
+			s.logger.Println("Error rolling back image record:", derr)
+		}
+		refund()
+		return nil, &APIError{http.StatusInternalServerError, "store_failed", "Could not store image"}
+	}
+	if !redirect {
+		s.similar.Add(image.Hash, image.UUID)
 	}
 
-	// done
-	http.Redirect(w, r, fmt.Sprintf("/view/%s", image.UUID), http.StatusFound)
+	return image, nil
+}
+
+// uploadError maps errors from reading and staging an upload to API errors.
+func uploadError(err error) *APIError {
+	var tooLarge *http.MaxBytesError
+	var overLimit *ImageLimitError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &APIError{http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Upload exceeds %d bytes", maxUploadSize)}
+	case errors.As(err, &overLimit):
+		return &APIError{http.StatusRequestEntityTooLarge, "image_too_large", overLimit.Error()}
+	case err == ErrUnsupportedType:
+		return &APIError{http.StatusUnprocessableEntity, "invalid_image", "File is not a supported image"}
+	case err == ErrDecode:
+		return &APIError{http.StatusUnprocessableEntity, "invalid_image", "Image could not be decoded"}
+	}
+	return &APIError{http.StatusBadRequest, "invalid_form", "Upload is malformed"}
 }
 
 func (s *Server) ViewImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -162,15 +360,30 @@ func (s *Server) ViewImage(w http.ResponseWriter, r *http.Request, params httpro
 	cookie := r.Context().Value(AppCookie).(string)
 	image, err := s.imageDao.Load(UUID)
 	if err != nil || image == nil {
+		if wantsJSON(r) {
+			s.writeError(w, errNotFound)
+			return
+		}
 		s.NotFound(w, nil, nil)
 		return
 	}
+	if wantsJSON(r) {
+		s.writeJSON(w, http.StatusOK, s.imageDoc(r, image, cookie == image.cookie))
+		return
+	}
 	data := &Page{
 		Title: "View",
 		UUID:  UUID,
 		Image: image,
 		Owned: cookie == image.cookie,
 	}
+	if r.URL.Query().Get("duplicate") != "" {
+		data.Notice = "Your upload was not saved because it looks like this image, uploaded earlier."
+	} else if n, _ := strconv.Atoi(r.URL.Query().Get("similar")); n == 1 {
+		data.Notice = "This looks like an image that was already uploaded."
+	} else if n > 1 {
+		data.Notice = fmt.Sprintf("This looks like %d images that were already uploaded.", n)
+	}
 	s.render("view", w, data)
 }
 
@@ -184,18 +397,86 @@ func (s *Server) GetImage(w http.ResponseWriter, r *http.Request, params httprou
 		return
 	}
 
-	// Check file is present before trying to serve. If it does not, ServeFile will
-	// do some redirects trying to help.
+	variant, err := s.fs.ParseVariant(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if variant != nil {
+		s.serveVariant(w, r, image, variant)
+		return
+	}
+	if r.URL.Query().Get("poster") != "" {
+		if image.Frames > 1 {
+			s.serveVariant(w, r, image, posterVariant)
+			return
+		}
+		thumbnail = "true" // still images are their own poster
+	}
+
+	// Check file is present before trying to serve.
 	orig, thumb := s.fs.Ensure(image)
 
+	if thumbnail != "" && !thumb && orig {
+		// The thumbnail was evicted from the cache, render it again.
+		if err = s.fs.Thumbnail(image); err != nil {
+			s.logger.Println("Error regenerating thumbnail:", err)
+		} else {
+			thumb = true
+		}
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	kind := "original"
 	if thumbnail != "" && thumb {
-		http.ServeFile(w, r, image.thumbPath)
+		s.fs.cache.Touch(image.thumbPath)
+		kind = "thumbnail"
+		err = s.fs.Stream(rec, r, s.negotiate(w, r, image, image.thumbPath))
 	} else if orig {
-		http.ServeFile(w, r, image.path)
+		err = s.fs.Stream(rec, r, image.path)
 	} else {
 		// Something is wrong here.
 		s.NotFound(w, nil, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Println("Error streaming image:", err)
+		s.NotFound(w, nil, nil)
+		return
+	}
+	metrics.Serve(kind, rec.bytes)
+}
+
+// serveVariant serves a resized or converted copy of image, rendering and
+// caching it on first request.
+func (s *Server) serveVariant(w http.ResponseWriter, r *http.Request, image *Image, variant *Variant) {
+	key, created, err := s.fs.Render(image, variant)
+	if err != nil {
+		s.logger.Println("Error rendering variant:", err)
+		s.NotFound(w, nil, nil)
+		return
+	}
+	if created {
+		var size int64
+		if info, err := s.fs.storage.Stat(key); err == nil {
+			size = info.Size
+		}
+		if err = s.imageDao.AddDerivative(image.path, key, size); err != nil {
+			s.logger.Println(err)
+		}
+	} else {
+		s.fs.cache.Touch(key)
+	}
+	if variant.Format == "" {
+		key = s.negotiate(w, r, image, key)
 	}
+	rec := &responseRecorder{ResponseWriter: w}
+	if err = s.fs.Stream(rec, r, key); err != nil {
+		s.logger.Println("Error streaming image:", err)
+		s.NotFound(w, nil, nil)
+		return
+	}
+	metrics.Serve("variant", rec.bytes)
 }
 
 // DeleteImage - Delete an image given its UUID and valid delete key.
@@ -203,7 +484,7 @@ func (s *Server) DeleteImage(w http.ResponseWriter, r *http.Request, params http
 	UUID := params.ByName("UUID")
 	deleteKey := params.ByName("key")
 	image, err := s.imageDao.Load(UUID)
-	if err != nil {
+	if err != nil || image == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -211,13 +492,13 @@ func (s *Server) DeleteImage(w http.ResponseWriter, r *http.Request, params http
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-	err = s.imageDao.Delete(image)
+	orphans, err := s.imageDao.Delete(image)
 	if err != nil {
 		s.logger.Println(err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	err = s.fs.Delete(image)
+	err = s.fs.Delete(orphans)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -244,48 +525,103 @@ func (s *Server) initRoutes() {
 		rice.MustFindBox("static/css").HTTPBox(),
 	)
 
-	s.router.GET("/", s.Index)
+	s.handle("GET", "/", s.Index)
 	// UI
-	s.router.POST("/upload", s.Upload)
-	s.router.GET("/recent", s.ViewRecent)
-	s.router.GET("/about", s.About)
-	s.router.GET("/404", s.NotFound)
-	s.router.GET("/view/:UUID", s.ViewImage)
+	s.handle("POST", "/upload", s.Upload)
+	s.handle("GET", "/recent", s.ViewRecent)
+	s.handle("GET", "/mine", s.ViewMine)
+	s.handle("GET", "/u/:owner", s.ViewOwner)
+	s.handle("GET", "/about", s.About)
+	s.handle("GET", "/404", s.NotFound)
+	s.handle("GET", "/view/:UUID", s.ViewImage)
+	s.handle("GET", "/view/:UUID/similar", s.ViewSimilar)
 	// API
-	s.router.GET("/i/:UUID", s.GetImage)
-	s.router.GET("/d/:UUID/:key", s.DeleteImage)
+	s.handle("GET", "/i/:UUID", s.GetImage)
+	s.handle("GET", "/d/:UUID/:key", s.DeleteImage)
+	s.handle("GET", "/metrics", s.Metrics)
+	s.handle("GET", "/healthz", s.Healthz)
+	s.handle("GET", "/readyz", s.Readyz)
+	s.initAPIRoutes()
+	s.initAdminRoutes()
+}
+
+// handle registers h for method and path, recording request metrics
+// under the route pattern rather than the requested URL.
+func (s *Server) handle(method string, path string, h httprouter.Handle) {
+	s.router.Handle(method, path, metrics.Instrument(path, h))
 }
 
-// ListenAndServe ...
-func (s *Server) ListenAndServe() {
-	log.Fatal(
-		http.ListenAndServe(
-			cfg.bind,
-			s.logger.Handler(
-				cookies(s.router),
-			),
+// ListenAndServe serves until Shutdown is called, after which it returns
+// nil.
+func (s *Server) ListenAndServe() error {
+	s.http = &http.Server{
+		Addr: cfg.bind,
+		Handler: s.logger.Handler(
+			s.cookies(s.router),
 		),
-	)
+	}
+	if err := s.http.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-func cookies(h http.Handler) http.Handler {
+// Shutdown stops accepting connections and waits for in-flight requests,
+// such as uploads, to finish or ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.http == nil {
+		return nil
+	}
+	return s.http.Shutdown(ctx)
+}
+
+// cookies identifies the browser by its signed goimg cookie, issuing a new
+// one if it has none or it doesn't verify. Cookies signed with an older key
+// are signed again with the current one, and so are unsigned cookies from
+// before signing, the first time they come back before the cut-off date.
+func (s *Server) cookies(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var cookie *http.Cookie
+		var id string
 		cookie, err := r.Cookie(AppCookie)
+		if err == nil {
+			var current bool
+			id, current, err = s.signer.Verify(cookie.Value)
+			if err == ErrUnsignedCookie && s.legacyCookie(cookie.Value) {
+				id, current, err = cookie.Value, false, nil
+			}
+			if err == nil && !current {
+				s.setCookie(w, r, id)
+			}
+		}
 		if err != nil {
 			// Set cookie
-			val, _ := shortid.Generate()
-			cookie = &http.Cookie{Name: AppCookie, Value: val}
-			http.SetCookie(w, cookie)
+			id, _ = shortid.Generate()
+			s.setCookie(w, r, id)
 		}
 		// Store value in requst context for later
-		ctx := context.WithValue(r.Context(), cookie.Name, cookie.Value)
+		ctx := context.WithValue(r.Context(), AppCookie, id)
 		h.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// legacyCookie reports whether the unsigned cookie value may be signed.
+func (s *Server) legacyCookie(value string) bool {
+	if !s.signer.AcceptsLegacy() {
+		return false
+	}
+	claimed, err := s.imageDao.ClaimLegacyCookie(value)
+	if err != nil {
+		s.logger.Println("Error claiming unsigned cookie:", err)
+	}
+	return claimed
+}
+
 func itob(v int) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, uint64(v))
 	return b
 }
+
+func btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// freeSpace isn't implemented here, so /readyz skips the free space check.
+func freeSpace(path string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	STORAGE_DISK string = "disk"
+	STORAGE_S3   string = "s3"
+)
+
+// StorageInfo describes a stored object.
+type StorageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where image bytes live. Keys are flat names such as
+// "abc123.png". Implementations return an error satisfying os.IsNotExist
+// when a key is missing.
+type Storage interface {
+	// Put stores everything read from r under key, replacing any existing object.
+	Put(key string, r io.Reader) error
+	// Get opens the object stored under key.
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns information about the object stored under key.
+	Stat(key string) (*StorageInfo, error)
+	// Delete removes the object stored under key.
+	Delete(key string) error
+	// Stream writes the object stored under key as an HTTP response,
+	// honoring conditional and range requests.
+	Stream(w http.ResponseWriter, r *http.Request, key string) error
+	// List calls fn for every stored object, stopping at the first error.
+	List(fn func(key string, info *StorageInfo) error) error
+}
+
+// Mover is implemented by storage backends that can take ownership of a
+// local file without copying it.
+type Mover interface {
+	// Move atomically renames the file at path into storage under key.
+	Move(path string, key string) error
+}
+
+// NewStorage returns the storage backend selected by cfg.storage.
+func NewStorage(cfg Config) (Storage, error) {
+	switch cfg.storage {
+	case "", STORAGE_DISK:
+		return NewDiskStorage(cfg.data), nil
+	case STORAGE_S3:
+		return NewS3Storage(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.storage)
+	}
+}
+
+// DiskStorage keeps objects as files in a single directory.
+type DiskStorage struct {
+	root string
+}
+
+func NewDiskStorage(root string) *DiskStorage {
+	return &DiskStorage{
+		root: root,
+	}
+}
+
+// path maps key to a file in the root directory. Older databases stored
+// full paths instead of keys, so only the base name is used.
+func (ds *DiskStorage) path(key string) string {
+	return filepath.Join(ds.root, filepath.Base(key))
+}
+
+func (ds *DiskStorage) Put(key string, r io.Reader) error {
+	// Write to a temporary file first so readers never see a partial object.
+	tmp, err := ioutil.TempFile(ds.root, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return ds.Move(tmp.Name(), key)
+}
+
+// Move renames the file at path into the root directory. path must be on
+// the same filesystem, e.g. a temporary file created in the root.
+func (ds *DiskStorage) Move(path string, key string) error {
+	if err := os.Chmod(path, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path, ds.path(key))
+}
+
+func (ds *DiskStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(ds.path(key))
+}
+
+func (ds *DiskStorage) Stat(key string) (*StorageInfo, error) {
+	finfo, err := os.Stat(ds.path(key))
+	if err != nil {
+		return nil, err
+	}
+	return &StorageInfo{Size: finfo.Size(), ModTime: finfo.ModTime()}, nil
+}
+
+func (ds *DiskStorage) Delete(key string) error {
+	return os.Remove(ds.path(key))
+}
+
+// List skips dot files, which are temporary files still being written.
+func (ds *DiskStorage) List(fn func(key string, info *StorageInfo) error) error {
+	files, err := ioutil.ReadDir(ds.root)
+	if err != nil {
+		return err
+	}
+	for _, finfo := range files {
+		if finfo.IsDir() || strings.HasPrefix(finfo.Name(), ".") {
+			continue
+		}
+		if err = fn(finfo.Name(), &StorageInfo{Size: finfo.Size(), ModTime: finfo.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *DiskStorage) Stream(w http.ResponseWriter, r *http.Request, key string) error {
+	file, err := os.Open(ds.path(key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// ServeContent, unlike ServeFile, does not redirect on index.html-like paths.
+	http.ServeContent(w, r, finfo.Name(), finfo.ModTime(), file)
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// API tokens, stored as JSON under the SHA-256 of the secret so the
+	// secret itself is never kept
+	TOKEN_BUCKET string = "tokens"
+	TOKEN_PREFIX string = "goimg_"
+
+	SCOPE_UPLOAD     string = "upload"     // upload images, recorded against the token
+	SCOPE_DELETE_OWN string = "delete-own" // delete and edit images uploaded with the token
+	SCOPE_ADMIN      string = "admin"      // the /admin endpoints, and deleting any image
+)
+
+var (
+	ErrTokenExists   = errors.New("a token with this name already exists")
+	ErrTokenNotFound = errors.New("no such token")
+
+	errInvalidToken = &APIError{http.StatusUnauthorized, "invalid_token", "Missing, invalid or revoked API token"}
+	errTokenScope   = &APIError{http.StatusForbidden, "insufficient_scope", "API token does not allow this"}
+)
+
+// Token is a named API token for programmatic clients such as CI bots.
+type Token struct {
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	Created string   `json:"created"` // RFC3339
+
+	// Daily limits for uploads made with the token, 0 for unlimited.
+	// They replace the per client limits.
+	QuotaUploads int `json:"quota_uploads,omitempty"`
+	QuotaBytes   int `json:"quota_bytes,omitempty"` // MB
+}
+
+// Has reports whether the token was granted scope.
+func (t *Token) Has(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope string) bool {
+	switch scope {
+	case SCOPE_UPLOAD, SCOPE_DELETE_OWN, SCOPE_ADMIN:
+		return true
+	}
+	return false
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken stores a new token and returns its secret, which can't be
+// recovered later.
+func (dao *ImageDao) CreateToken(token *Token) (string, error) {
+	if token.Name == "" {
+		return "", errors.New("token name is required")
+	}
+	for _, scope := range token.Scopes {
+		if !validScope(scope) {
+			return "", fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := TOKEN_PREFIX + hex.EncodeToString(b)
+	token.Created = time.Now().UTC().Format(time.RFC3339)
+
+	err := dao.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(TOKEN_BUCKET))
+		if _, existing, _ := findToken(bucket, token.Name); existing != nil {
+			return ErrTokenExists
+		}
+		v, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(B(hashToken(secret)), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// RevokeToken deletes the token called name. Images uploaded with it keep
+// its name.
+func (dao *ImageDao) RevokeToken(name string) error {
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(B(TOKEN_BUCKET))
+		k, token, err := findToken(bucket, name)
+		if err != nil {
+			return err
+		} else if token == nil {
+			return ErrTokenNotFound
+		}
+		return bucket.Delete(k)
+	})
+}
+
+// Tokens returns every token, sorted by name.
+func (dao *ImageDao) Tokens() ([]*Token, error) {
+	var tokens []*Token
+	err := dao.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(B(TOKEN_BUCKET)).ForEach(func(k, v []byte) error {
+			token := &Token{}
+			if err := json.Unmarshal(v, token); err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	return tokens, err
+}
+
+// LookupToken returns the token with the given secret, or nil if there is
+// none.
+func (dao *ImageDao) LookupToken(secret string) (*Token, error) {
+	var token *Token
+	err := dao.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(B(TOKEN_BUCKET)).Get(B(hashToken(secret)))
+		if v == nil {
+			return nil
+		}
+		token = &Token{}
+		return json.Unmarshal(v, token)
+	})
+	return token, err
+}
+
+// findToken scans bucket for the token called name, there are few enough.
+func findToken(bucket *bolt.Bucket, name string) ([]byte, *Token, error) {
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		token := &Token{}
+		if err := json.Unmarshal(v, token); err != nil {
+			return nil, nil, err
+		}
+		if token.Name == name {
+			return k, token, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// bearerToken returns the API token the request carries, nil if it
+// carries none, or an error if it isn't a valid token.
+func (s *Server) bearerToken(r *http.Request) (*Token, *APIError) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	secret := strings.TrimPrefix(auth, "Bearer ")
+	if secret == auth || !strings.HasPrefix(secret, TOKEN_PREFIX) {
+		return nil, errInvalidToken
+	}
+	token, err := s.imageDao.LookupToken(secret)
+	if err != nil {
+		s.logger.Println("Error looking up API token:", err)
+		return nil, toAPIError(err)
+	} else if token == nil {
+		return nil, errInvalidToken
+	}
+	return token, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	MODE_FIT  string = "fit"  // scale down to fit within width x height
+	MODE_FILL string = "fill" // scale and crop to exactly width x height
+	MODE_CROP string = "crop" // crop the center width x height without scaling
+)
+
+var (
+	ErrVariantSize    = errors.New("requested size is not allowed")
+	ErrVariantQuality = errors.New("requested quality is not allowed")
+)
+
+// posterVariant is a still of the first frame of an animation, the size
+// of a thumbnail, shown in image grids.
+var posterVariant = &Variant{Width: THUMB_SIZE, Height: THUMB_SIZE, Mode: MODE_FIT}
+
+// Variant describes a derivative of an original image requested through
+// query parameters on /i/:UUID.
+type Variant struct {
+	Width   int
+	Height  int
+	Mode    string
+	Format  string // file extension, e.g. "jpg"
+	Quality int    // JPEG quality, 0 for the default
+}
+
+// ParseVariant reads width, height, mode, format and quality from query.
+// It returns nil if none are present. Sizes and qualities must appear in
+// the configured allow-lists so clients cannot fill the cache with
+// arbitrary variants.
+func (fs *FS) ParseVariant(query url.Values) (*Variant, error) {
+	if query.Get("width") == "" && query.Get("height") == "" && query.Get("format") == "" && query.Get("quality") == "" {
+		return nil, nil
+	}
+
+	v := &Variant{Mode: MODE_FIT}
+	var err error
+	if width := query.Get("width"); width != "" {
+		if v.Width, err = strconv.Atoi(width); err != nil || v.Width < 0 {
+			return nil, fmt.Errorf("invalid width: %s", width)
+		}
+	}
+	if height := query.Get("height"); height != "" {
+		if v.Height, err = strconv.Atoi(height); err != nil || v.Height < 0 {
+			return nil, fmt.Errorf("invalid height: %s", height)
+		}
+	}
+	if (v.Width != 0 || v.Height != 0) && !allowed(fs.cfg.sizes, fmt.Sprintf("%dx%d", v.Width, v.Height)) {
+		return nil, ErrVariantSize
+	}
+
+	if mode := query.Get("mode"); mode != "" {
+		switch mode {
+		case MODE_FIT, MODE_FILL, MODE_CROP:
+			v.Mode = mode
+		default:
+			return nil, fmt.Errorf("invalid mode: %s", mode)
+		}
+	}
+	if v.Mode != MODE_FIT && (v.Width == 0 || v.Height == 0) {
+		return nil, fmt.Errorf("mode %s requires both width and height", v.Mode)
+	}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if _, err = imaging.FormatFromExtension(format); err != nil && format != "webp" {
+			return nil, fmt.Errorf("invalid format: %s", format)
+		}
+		v.Format = format
+	}
+
+	if quality := query.Get("quality"); quality != "" {
+		if !allowed(fs.cfg.qualities, quality) {
+			return nil, ErrVariantQuality
+		}
+		v.Quality, _ = strconv.Atoi(quality)
+	}
+
+	return v, nil
+}
+
+// Key returns the storage key of this variant of the stored file blobKey.
+func (v *Variant) Key(blobKey string) string {
+	base := path.Base(blobKey)
+	ext := path.Ext(base)
+	format := v.Format
+	if format == "" {
+		format = strings.TrimPrefix(ext, ".")
+	}
+	return fmt.Sprintf("%s_%dx%d_%s_q%d.%s", strings.TrimSuffix(base, ext), v.Width, v.Height, v.Mode, v.Quality, format)
+}
+
+// allowed reports whether value appears in the comma separated list.
+func allowed(list string, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == value {
+			return true
+		}
+	}
+	return false
+}
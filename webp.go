@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// Browsers that accept WebP are sent WebP copies of thumbnails and resized
+// images. The encoder is lossless, so the copies pay off for images that
+// were lossless to begin with, such as PNG screenshots, and not for JPEG
+// photos. A copy that is no smaller than the file it was made from is
+// dropped and that file served instead. Lossy WebP and AVIF would suit
+// photos, but have no encoder in pure Go, so they aren't offered.
+
+// webpKey returns the key of the WebP copy of the derived file key.
+func webpKey(key string) string {
+	return key + ".webp"
+}
+
+// RenderWebP stores a WebP copy of the derived file key under alt, and
+// returns its size or 0 if it was no smaller and dropped.
+func (fs *FS) RenderWebP(key string, alt string) (int64, error) {
+	err := fs.flight.Do(alt, func() error {
+		src, err := fs.storage.Get(key)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+		img, err := decode(bytes.NewReader(data), fs.cfg)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err = nativewebp.Encode(&buf, img, nil); err != nil {
+			return err
+		}
+		if buf.Len() >= len(data) {
+			fs.logger.Printf("WebP copy of %s is no smaller, not keeping it\n", key)
+			return nil
+		}
+		size := int64(buf.Len())
+		if err = fs.storage.Put(alt, &buf); err != nil {
+			return err
+		}
+		fs.cache.Add(alt, size)
+		fs.logger.Printf("Rendered: %s\n", alt)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	info, err := fs.storage.Stat(alt)
+	if err != nil {
+		return 0, nil
+	}
+	return info.Size, nil
+}
+
+// negotiate returns the key to serve for the derived file key of image:
+// its WebP copy if the client accepts WebP and the copy is smaller, and
+// key otherwise. Animated GIFs and APNG thumbnails keep their format, the
+// copies are stills.
+func (s *Server) negotiate(w http.ResponseWriter, r *http.Request, image *Image, key string) string {
+	ext := path.Ext(key)
+	if !s.config.webp || ext == ".gif" || ext == ".webp" || (key == image.thumbPath && image.Frames > 1) {
+		return key
+	}
+	w.Header().Add("Vary", "Accept")
+	if !accepts(r, "image/webp") {
+		return key
+	}
+
+	alt := webpKey(key)
+	size, known := s.imageDao.DerivativeSize(image.path, alt)
+	if known && size == 0 {
+		return key
+	}
+	if known && s.fs.exists(alt) {
+		s.fs.cache.Touch(alt)
+		return alt
+	}
+	size, err := s.fs.RenderWebP(key, alt)
+	if err != nil {
+		s.logger.Println("Error rendering WebP copy:", err)
+		return key
+	}
+	if err = s.imageDao.AddDerivative(image.path, alt, size); err != nil {
+		s.logger.Println(err)
+	}
+	if size == 0 {
+		return key
+	}
+	return alt
+}
+
+// accepts reports whether the Accept header of r lists mediaType, other
+// than with q=0. Wildcards don't count, browsers send them for formats
+// they can't show.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || t != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err != nil || q > 0 {
+			return true
+		}
+	}
+	return false
+}